@@ -0,0 +1,227 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrBatchOpNotExecuted is returned by a BatchOp that was not executed
+// because an earlier operation in the batch failed.
+var ErrBatchOpNotExecuted = errors.New("batch operation not executed")
+
+// Batch queues operations on a web page and sends them to the process in a
+// single request. Operations are executed in order and execution stops at
+// the first operation that raises an error within the process.
+//
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	page *WebPage
+	ops  []*BatchOp
+}
+
+// Batch returns a new, empty batch for the page.
+func (p *WebPage) Batch() *Batch {
+	return &Batch{page: p}
+}
+
+// Len returns the number of queued operations.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Exec sends all queued operations to the process and clears the queue.
+// Returns the error from the first failed operation, if any.
+func (b *Batch) Exec() error {
+	ops := b.ops
+	b.ops = nil
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// Mark all operations as not executed until we receive results.
+	reqOps := make([]batchOpJSON, len(ops))
+	for i, op := range ops {
+		op.err = ErrBatchOpNotExecuted
+		reqOps[i] = batchOpJSON{Path: op.path, Req: op.req}
+	}
+
+	var resp struct {
+		Results []json.RawMessage `json:"results"`
+		Error   *struct {
+			Index   int    `json:"index"`
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if err := b.page.doJSON("/webpage/Batch", map[string]interface{}{"ref": b.page.ref.id, "ops": reqOps}, &resp); err != nil {
+		return err
+	}
+
+	// Assign results to each successful operation.
+	for i, value := range resp.Results {
+		if i < len(ops) {
+			ops[i].value, ops[i].err = value, nil
+		}
+	}
+	if resp.Error != nil && resp.Error.Index < len(ops) {
+		op := ops[resp.Error.Index]
+		op.err = &RemoteError{Endpoint: op.path, Code: resp.Error.Code, Message: resp.Error.Message}
+	}
+
+	// Run client-side checks and return the first error.
+	for i, op := range ops {
+		if op.err == nil && op.check != nil {
+			op.err = op.check(op.value)
+		}
+		if op.err != nil && op.err != ErrBatchOpNotExecuted {
+			return &BatchError{Index: i, Err: op.err}
+		}
+	}
+	return nil
+}
+
+// add queues an operation for the given endpoint.
+func (b *Batch) add(path string, req map[string]interface{}) *BatchOp {
+	op := &BatchOp{path: path, req: req}
+	b.ops = append(b.ops, op)
+	return op
+}
+
+// Open queues WebPage.Open().
+func (b *Batch) Open(url string) *BatchOp {
+	op := b.add("/webpage/Open", map[string]interface{}{"url": url})
+	op.check = func(value json.RawMessage) error {
+		var resp struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(value, &resp); err != nil {
+			return err
+		} else if resp.Status != "success" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	return op
+}
+
+// SetClipRect queues WebPage.SetClipRect().
+func (b *Batch) SetClipRect(rect Rect) *BatchOp {
+	return b.add("/webpage/SetClipRect", map[string]interface{}{
+		"rect": rectJSON{Top: rect.Top, Left: rect.Left, Width: rect.Width, Height: rect.Height},
+	})
+}
+
+// SetContent queues WebPage.SetContent().
+func (b *Batch) SetContent(content string) *BatchOp {
+	return b.add("/webpage/SetContent", map[string]interface{}{"content": content})
+}
+
+// SetContentAndURL queues WebPage.SetContentAndURL().
+func (b *Batch) SetContentAndURL(content, url string) *BatchOp {
+	return b.add("/webpage/SetContentAndURL", map[string]interface{}{"content": content, "url": url})
+}
+
+// SetCookies queues WebPage.SetCookies().
+func (b *Batch) SetCookies(cookies []*http.Cookie) *BatchOp {
+	a := make([]cookieJSON, len(cookies))
+	for i := range cookies {
+		a[i] = encodeCookieJSON(cookies[i])
+	}
+	return b.add("/webpage/SetCookies", map[string]interface{}{"cookies": a})
+}
+
+// AddCookie queues WebPage.AddCookie().
+// The operation's value is decoded as {"returnValue": bool}.
+func (b *Batch) AddCookie(cookie *http.Cookie) *BatchOp {
+	return b.add("/webpage/AddCookie", map[string]interface{}{"cookie": encodeCookieJSON(cookie)})
+}
+
+// SetCustomHeaders queues WebPage.SetCustomHeaders().
+func (b *Batch) SetCustomHeaders(header http.Header) *BatchOp {
+	m := make(map[string]string)
+	for key := range header {
+		m[key] = header.Get(key)
+	}
+	return b.add("/webpage/SetCustomHeaders", map[string]interface{}{"headers": m})
+}
+
+// SetPaperSize queues WebPage.SetPaperSize().
+func (b *Batch) SetPaperSize(size PaperSize) *BatchOp {
+	return b.add("/webpage/SetPaperSize", map[string]interface{}{"size": encodePaperSizeJSON(size)})
+}
+
+// SetScrollPosition queues WebPage.SetScrollPosition().
+func (b *Batch) SetScrollPosition(pos Position) *BatchOp {
+	return b.add("/webpage/SetScrollPosition", map[string]interface{}{"top": pos.Top, "left": pos.Left})
+}
+
+// SetSettings queues WebPage.SetSettings().
+func (b *Batch) SetSettings(settings WebPageSettings) *BatchOp {
+	return b.add("/webpage/SetSettings", map[string]interface{}{"settings": encodeWebPageSettingsJSON(settings)})
+}
+
+// SetViewportSize queues WebPage.SetViewportSize().
+func (b *Batch) SetViewportSize(width, height int) *BatchOp {
+	return b.add("/webpage/SetViewportSize", map[string]interface{}{"width": width, "height": height})
+}
+
+// SetZoomFactor queues WebPage.SetZoomFactor().
+func (b *Batch) SetZoomFactor(factor float64) *BatchOp {
+	return b.add("/webpage/SetZoomFactor", map[string]interface{}{"value": factor})
+}
+
+// Evaluate queues WebPage.Evaluate().
+// The operation's value is decoded as {"returnValue": ...}.
+func (b *Batch) Evaluate(script string) *BatchOp {
+	return b.add("/webpage/Evaluate", map[string]interface{}{"script": script})
+}
+
+// BatchOp represents a single queued operation in a Batch.
+type BatchOp struct {
+	path  string
+	req   map[string]interface{}
+	check func(json.RawMessage) error
+
+	value json.RawMessage
+	err   error
+}
+
+// Err returns the error for the operation once its batch has executed.
+// Returns ErrBatchOpNotExecuted if an earlier operation failed.
+func (op *BatchOp) Err() error {
+	return op.err
+}
+
+// Decode unmarshals the operation's raw response into v.
+func (op *BatchOp) Decode(v interface{}) error {
+	if op.err != nil {
+		return op.err
+	} else if op.value == nil {
+		return ErrBatchOpNotExecuted
+	}
+	return json.Unmarshal(op.value, v)
+}
+
+// BatchError is returned by Batch.Exec() when an operation fails.
+type BatchError struct {
+	Index int   // position of the failed operation
+	Err   error // underlying error
+}
+
+// Error returns the error message.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// batchOpJSON is a struct for encoding batch operations as JSON.
+type batchOpJSON struct {
+	Path string                 `json:"path"`
+	Req  map[string]interface{} `json:"req"`
+}
@@ -0,0 +1,114 @@
+package phantomjs_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure batch executes operations in order and returns per-op results.
+func TestBatch_Exec(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	b := page.Batch()
+	b.SetViewportSize(100, 200)
+	b.SetZoomFactor(2)
+	b.SetContent(`<html><head></head><body>TEST</body></html>`)
+	eval := b.Evaluate(`function() { return document.body.innerText }`)
+	if b.Len() != 4 {
+		t.Fatalf("unexpected len: %d", b.Len())
+	}
+	if err := b.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify result of evaluation.
+	var resp struct {
+		ReturnValue string `json:"returnValue"`
+	}
+	if err := eval.Decode(&resp); err != nil {
+		t.Fatal(err)
+	} else if resp.ReturnValue != "TEST" {
+		t.Fatalf("unexpected return value: %q", resp.ReturnValue)
+	}
+
+	// Verify state was applied.
+	if width, height, err := page.ViewportSize(); err != nil {
+		t.Fatal(err)
+	} else if width != 100 || height != 200 {
+		t.Fatalf("unexpected viewport: %dx%d", width, height)
+	}
+	if v, err := page.ZoomFactor(); err != nil {
+		t.Fatal(err)
+	} else if v != 2 {
+		t.Fatalf("unexpected zoom factor: %v", v)
+	}
+}
+
+// Ensure batch returns the first failed operation.
+func TestBatch_Exec_Error(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	b := page.Batch()
+	op0 := b.SetZoomFactor(2)
+	op1 := b.Open("http://127.0.0.1:1/")
+
+	var berr *phantomjs.BatchError
+	if err := b.Exec(); !errors.As(err, &berr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if berr.Index != 1 {
+		t.Fatalf("unexpected index: %d", berr.Index)
+	}
+
+	if err := op0.Err(); err != nil {
+		t.Fatalf("unexpected op0 error: %v", err)
+	} else if err := op1.Err(); err == nil {
+		t.Fatal("expected op1 error")
+	}
+}
+
+// Ensure operations after a failed open are not executed.
+func TestBatch_Exec_OpenFailed(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	b := page.Batch()
+	op0 := b.Open("http://127.0.0.1:1/")
+	op1 := b.SetContent(`<html><head></head><body>TEST</body></html>`)
+
+	var berr *phantomjs.BatchError
+	var rerr *phantomjs.RemoteError
+	if err := b.Exec(); !errors.As(err, &berr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if berr.Index != 0 {
+		t.Fatalf("unexpected index: %d", berr.Index)
+	} else if !errors.As(err, &rerr) || rerr.Code != phantomjs.ErrorCodeOpenFailed {
+		t.Fatalf("unexpected remote error: %v", err)
+	}
+
+	if err := op0.Err(); err == nil {
+		t.Fatal("expected op0 error")
+	} else if err := op1.Err(); err != phantomjs.ErrBatchOpNotExecuted {
+		t.Fatalf("unexpected op1 error: %v", err)
+	}
+
+	// The page content should not have been replaced.
+	if content, err := page.Content(); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(content, "TEST") {
+		t.Fatalf("unexpected content: %q", content)
+	}
+}
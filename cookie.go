@@ -0,0 +1,186 @@
+package phantomjs
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Cookies returns all cookies in the process' cookie jar.
+// These are shared by all pages unless a page uses its own cookie jar.
+func (p *Process) Cookies() ([]*http.Cookie, error) {
+	var resp struct {
+		Value []cookieJSON `json:"value"`
+	}
+	if err := p.doJSON("/process/Cookies", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]*http.Cookie, len(resp.Value))
+	for i := range resp.Value {
+		a[i] = decodeCookieJSON(resp.Value[i])
+	}
+	return a, nil
+}
+
+// SetCookies replaces all cookies in the process' cookie jar.
+func (p *Process) SetCookies(cookies []*http.Cookie) error {
+	a := make([]cookieJSON, len(cookies))
+	for i := range cookies {
+		a[i] = encodeCookieJSON(cookies[i])
+	}
+	return p.doJSON("/process/SetCookies", map[string]interface{}{"cookies": a}, nil)
+}
+
+// AddCookie adds a cookie to the process' cookie jar.
+// Returns true if the cookie was successfully added.
+func (p *Process) AddCookie(cookie *http.Cookie) (bool, error) {
+	var resp struct {
+		ReturnValue bool `json:"returnValue"`
+	}
+	if err := p.doJSON("/process/AddCookie", map[string]interface{}{"cookie": encodeCookieJSON(cookie)}, &resp); err != nil {
+		return false, err
+	}
+	return resp.ReturnValue, nil
+}
+
+// DeleteCookie removes all cookies with a matching name from the process'
+// cookie jar. Returns true if a cookie was successfully deleted.
+func (p *Process) DeleteCookie(name string) (bool, error) {
+	var resp struct {
+		ReturnValue bool `json:"returnValue"`
+	}
+	if err := p.doJSON("/process/DeleteCookie", map[string]interface{}{"name": name}, &resp); err != nil {
+		return false, err
+	}
+	return resp.ReturnValue, nil
+}
+
+// ClearCookies deletes all cookies from the process' cookie jar.
+func (p *Process) ClearCookies() error {
+	return p.doJSON("/process/ClearCookies", nil, nil)
+}
+
+// CookiesEnabled returns true if cookies are enabled for the process.
+func (p *Process) CookiesEnabled() (bool, error) {
+	var resp struct {
+		Value bool `json:"value"`
+	}
+	if err := p.doJSON("/process/CookiesEnabled", nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Value, nil
+}
+
+// SetCookiesEnabled enables or disables cookies for the process.
+func (p *Process) SetCookiesEnabled(v bool) error {
+	return p.doJSON("/process/SetCookiesEnabled", map[string]interface{}{"value": v}, nil)
+}
+
+// SaveCookies copies all cookies from the process' cookie jar into jar so
+// they can be used by an http.Client.
+func (p *Process) SaveCookies(jar http.CookieJar) error {
+	cookies, err := p.Cookies()
+	if err != nil {
+		return err
+	}
+	SaveCookiesToJar(jar, cookies)
+	return nil
+}
+
+// LoadCookies adds the cookies that jar would send to u to the process'
+// cookie jar. Existing cookies with the same name, domain and path are
+// replaced and all other cookies are kept.
+func (p *Process) LoadCookies(jar http.CookieJar, u *url.URL) error {
+	for _, cookie := range CookiesFromJar(jar, u) {
+		if _, err := p.AddCookie(cookie); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveCookies copies the cookies visible to the page's current URL into jar
+// so they can be used by an http.Client.
+func (p *WebPage) SaveCookies(jar http.CookieJar) error {
+	cookies, err := p.Cookies()
+	if err != nil {
+		return err
+	}
+	SaveCookiesToJar(jar, cookies)
+	return nil
+}
+
+// LoadCookies adds the cookies that jar would send to u to the page.
+func (p *WebPage) LoadCookies(jar http.CookieJar, u *url.URL) error {
+	return p.Do(func(page *WebPage) error {
+		for _, cookie := range CookiesFromJar(jar, u) {
+			if _, err := page.AddCookie(cookie); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveCookiesToJar stores cookies returned by PhantomJS in jar. Each cookie
+// is stored for a URL built from its domain, path and secure flag so that the
+// jar applies the same scoping rules as the browser. Cookies without a domain
+// are skipped.
+func SaveCookiesToJar(jar http.CookieJar, cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		if cookie.Domain == "" {
+			continue
+		}
+
+		u := &url.URL{Scheme: "http", Host: strings.TrimPrefix(cookie.Domain, "."), Path: cookie.Path}
+		if cookie.Secure {
+			u.Scheme = "https"
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+
+		// PhantomJS prefixes domain cookies with a dot. Cookies without the
+		// prefix only apply to their exact host.
+		c := *cookie
+		if !strings.HasPrefix(c.Domain, ".") {
+			c.Domain = ""
+		}
+		jar.SetCookies(u, []*http.Cookie{&c})
+	}
+}
+
+// CookiesFromJar returns the cookies that jar would send to u, with their
+// domain and path set so they can be passed to WebPage.AddCookie() or
+// Process.SetCookies().
+//
+// The conversion is lossy. The jar only exposes each cookie's name and value
+// so the original domain, path, expiration and HttpOnly flag are unknown.
+// Each cookie is scoped to u's host only, to the directory of u's path, and
+// is marked secure if u uses HTTPS. Cookies set for a parent domain or a
+// broader path may therefore not be sent to other URLs they applied to.
+func CookiesFromJar(jar http.CookieJar, u *url.URL) []*http.Cookie {
+	cookies := jar.Cookies(u)
+	a := make([]*http.Cookie, len(cookies))
+	for i, cookie := range cookies {
+		a[i] = &http.Cookie{
+			Name:   cookie.Name,
+			Value:  cookie.Value,
+			Domain: u.Hostname(),
+			Path:   defaultCookiePath(u.Path),
+			Secure: u.Scheme == "https",
+		}
+	}
+	return a
+}
+
+// defaultCookiePath returns the directory of urlPath, as used for cookies
+// without a path attribute by RFC 6265, section 5.1.4.
+func defaultCookiePath(urlPath string) string {
+	i := strings.LastIndex(urlPath, "/")
+	if !strings.HasPrefix(urlPath, "/") || i == 0 {
+		return "/"
+	}
+	return urlPath[:i]
+}
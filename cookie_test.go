@@ -0,0 +1,282 @@
+package phantomjs_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure sessions flow between the browser and an http.Client in both directions.
+func TestWebPage_SaveCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: r.URL.Query().Get("user"), Path: "/"})
+		case "/whoami":
+			if c, err := r.Cookie("session"); err == nil {
+				w.Write([]byte("<html><body>" + c.Value + "</body></html>"))
+			}
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Log in with the browser and copy the session to the client.
+	jar, _ := cookiejar.New(nil)
+	if err := page.Open(srv.URL + "/login?user=susy"); err != nil {
+		t.Fatal(err)
+	} else if err := page.SaveCookies(jar); err != nil {
+		t.Fatal(err)
+	} else if body := MustGetBody(&http.Client{Jar: jar}, srv.URL+"/whoami"); !strings.Contains(body, "susy") {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	// Log in with the client and copy the session to the browser.
+	jar, _ = cookiejar.New(nil)
+	MustGetBody(&http.Client{Jar: jar}, srv.URL+"/login?user=bob")
+	if err := page.ClearCookies(); err != nil {
+		t.Fatal(err)
+	} else if err := page.LoadCookies(jar, u); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL + "/whoami"); err != nil {
+		t.Fatal(err)
+	} else if text, err := page.PlainText(); err != nil {
+		t.Fatal(err)
+	} else if text != "bob" {
+		t.Fatalf("unexpected text: %q", text)
+	}
+}
+
+// Ensure the process cookie jar can be read and replaced.
+func TestProcess_SetCookies(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	cookies := []*http.Cookie{{Name: "NAME", Value: "VALUE", Domain: ".example.com", Path: "/"}}
+	if err := p.SetCookies(cookies); err != nil {
+		t.Fatal(err)
+	} else if other, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(other) != 1 || other[0].Name != "NAME" || other[0].Value != "VALUE" || other[0].Domain != ".example.com" {
+		t.Fatalf("unexpected cookies: %#v", other)
+	}
+
+	// Loading cookies should keep existing cookies.
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse("http://localhost/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "xyz"}})
+	if err := p.LoadCookies(jar, u); err != nil {
+		t.Fatal(err)
+	} else if other, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(other) != 2 {
+		t.Fatalf("unexpected cookie count: %d", len(other))
+	}
+}
+
+// Ensure cookies can be added, deleted and cleared for the whole process.
+func TestProcess_AddCookie(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	if ok, err := p.AddCookie(&http.Cookie{Name: "A", Value: "1", Domain: "example.com", Path: "/"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected cookie to be added")
+	} else if ok, err := p.AddCookie(&http.Cookie{Name: "B", Value: "2", Domain: "example.com", Path: "/"}); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected cookie to be added")
+	}
+
+	// Cookies added to the process should be visible to pages.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContentAndURL(`<html></html>`, "http://example.com/"); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := page.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 2 {
+		t.Fatalf("unexpected page cookie count: %d", len(cookies))
+	}
+
+	if ok, err := p.DeleteCookie("A"); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected cookie to be deleted")
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "B" {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+
+	if err := p.ClearCookies(); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 0 {
+		t.Fatalf("unexpected cookie count: %d", len(cookies))
+	}
+}
+
+// Ensure resetting a page only clears cookies when it has its own cookie jar.
+func TestWebPage_Reset_Cookies(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	if _, err := p.AddCookie(&http.Cookie{Name: "A", Value: "1", Domain: "example.com", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resetting a page that shares the process' cookie jar keeps its cookies.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Reset(); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 {
+		t.Fatalf("unexpected cookie count: %d", len(cookies))
+	}
+
+	// Cookies on an isolated page are separate from the process and are
+	// cleared on reset.
+	isolated, err := p.CreateWebPageWithOptions(phantomjs.WebPageOptions{IsolateCookies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer MustClosePage(isolated)
+	if _, err := isolated.AddCookie(&http.Cookie{Name: "B", Value: "2", Domain: "example.com", Path: "/"}); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "A" {
+		t.Fatalf("unexpected process cookies: %#v", cookies)
+	}
+
+	if err := isolated.Reset(); err != nil {
+		t.Fatal(err)
+	} else if cookies, err := isolated.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 0 {
+		t.Fatalf("unexpected isolated cookie count: %d", len(cookies))
+	} else if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 {
+		t.Fatalf("unexpected process cookie count: %d", len(cookies))
+	}
+}
+
+// Ensure cookies can be disabled for the process.
+func TestProcess_SetCookiesEnabled(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	if v, err := p.CookiesEnabled(); err != nil {
+		t.Fatal(err)
+	} else if !v {
+		t.Fatal("expected cookies to be enabled by default")
+	}
+
+	if err := p.SetCookiesEnabled(false); err != nil {
+		t.Fatal(err)
+	} else if v, err := p.CookiesEnabled(); err != nil {
+		t.Fatal(err)
+	} else if v {
+		t.Fatal("expected cookies to be disabled")
+	}
+}
+
+// Ensure cookies are stored in a jar using the browser's scoping rules.
+func TestSaveCookiesToJar(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+	phantomjs.SaveCookiesToJar(jar, []*http.Cookie{
+		{Name: "domain", Value: "1", Domain: ".example.com", Path: "/"},
+		{Name: "host", Value: "2", Domain: "example.com", Path: "/"},
+		{Name: "secure", Value: "3", Domain: "example.com", Path: "/", Secure: true},
+		{Name: "path", Value: "4", Domain: "example.com", Path: "/admin"},
+	})
+
+	for _, tt := range []struct {
+		url   string
+		names []string
+	}{
+		{"http://example.com/", []string{"domain", "host"}},
+		{"https://example.com/admin/users", []string{"path", "domain", "host", "secure"}},
+		{"http://www.example.com/", []string{"domain"}},
+		{"http://other.com/", nil},
+	} {
+		u, _ := url.Parse(tt.url)
+		var names []string
+		for _, c := range jar.Cookies(u) {
+			names = append(names, c.Name)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("%s: unexpected cookies: %v", tt.url, names)
+		}
+	}
+}
+
+// Ensure cookies read from a jar are scoped to the URL's host.
+func TestCookiesFromJar(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse("https://example.com:8080/login")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "xyz", Path: "/"}})
+
+	if cookies := phantomjs.CookiesFromJar(jar, u); !reflect.DeepEqual(cookies, []*http.Cookie{
+		{Name: "session", Value: "xyz", Domain: "example.com", Path: "/", Secure: true},
+	}) {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+}
+
+// MustGetBody returns the body of a GET request to rawurl. Panic on error.
+func MustGetBody(client *http.Client, rawurl string) string {
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return string(buf)
+}
+
+// Ensure path scoped cookies keep their scope when copied between jars.
+func TestCookiesFromJar_Path(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse("http://example.com/app/settings")
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "xyz", Path: "/app"}})
+
+	cookies := phantomjs.CookiesFromJar(jar, u)
+	if !reflect.DeepEqual(cookies, []*http.Cookie{
+		{Name: "session", Value: "xyz", Domain: "example.com", Path: "/app"},
+	}) {
+		t.Fatalf("unexpected cookies: %#v", cookies)
+	}
+
+	// Copy back into a new jar and verify the cookie is only sent under /app.
+	other, _ := cookiejar.New(nil)
+	phantomjs.SaveCookiesToJar(other, cookies)
+	if a := other.Cookies(&url.URL{Scheme: "http", Host: "example.com", Path: "/app/profile"}); len(a) != 1 || a[0].Value != "xyz" {
+		t.Fatalf("unexpected cookies under path: %v", a)
+	} else if a := other.Cookies(&url.URL{Scheme: "http", Host: "example.com", Path: "/"}); len(a) != 0 {
+		t.Fatalf("unexpected cookies outside path: %v", a)
+	}
+}
@@ -0,0 +1,195 @@
+package phantomjs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// ErrInvalidImage is returned when a rendered image cannot be decoded.
+var ErrInvalidImage = errors.New("invalid image")
+
+// decodeImage decodes buf using the decoder for format. BMP and PPM images
+// are decoded directly since the standard library has no decoders for them.
+func decodeImage(format RenderFormat, buf []byte) (image.Image, error) {
+	switch format.normalize() {
+	case RenderFormatBMP:
+		return decodeBMP(buf)
+	case RenderFormatPPM:
+		return decodePPM(buf)
+	default:
+		img, _, err := image.Decode(bytes.NewReader(buf))
+		return img, err
+	}
+}
+
+// decodeBMP decodes an uncompressed 24-bit or 32-bit BMP image, such as the
+// images written by PhantomJS.
+func decodeBMP(buf []byte) (image.Image, error) {
+	if len(buf) < 54 || buf[0] != 'B' || buf[1] != 'M' {
+		return nil, fmt.Errorf("%w: bmp header", ErrInvalidImage)
+	}
+	offset := int(binary.LittleEndian.Uint32(buf[10:]))
+	headerSize := int(binary.LittleEndian.Uint32(buf[14:]))
+	width := int(int32(binary.LittleEndian.Uint32(buf[18:])))
+	height := int(int32(binary.LittleEndian.Uint32(buf[22:])))
+	bpp := int(binary.LittleEndian.Uint16(buf[28:]))
+	compression := binary.LittleEndian.Uint32(buf[30:])
+
+	// Rows are stored bottom-up unless the height is negative.
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || height <= 0 || headerSize < 40 {
+		return nil, fmt.Errorf("%w: bmp dimensions", ErrInvalidImage)
+	}
+
+	// Channel masks default to BGR(A) order. BI_BITFIELDS images store them
+	// after the 40 byte header or within larger headers.
+	masks := [4]uint32{0x00ff0000, 0x0000ff00, 0x000000ff, 0}
+	switch {
+	case compression == 0 && (bpp == 24 || bpp == 32):
+	case compression == 3 && bpp == 32 && len(buf) >= 14+40+12:
+		for i := 0; i < 3; i++ {
+			masks[i] = binary.LittleEndian.Uint32(buf[14+40+i*4:])
+		}
+		if headerSize >= 56 {
+			masks[3] = binary.LittleEndian.Uint32(buf[14+40+12:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported bmp: %d bpp, compression %d", ErrInvalidImage, bpp, compression)
+	}
+
+	stride := ((width*bpp + 31) / 32) * 4
+	if offset < 0 || offset+stride*height > len(buf) {
+		return nil, fmt.Errorf("%w: bmp data truncated", ErrInvalidImage)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := buf[offset+stride*y:]
+		dy := height - 1 - y
+		if topDown {
+			dy = y
+		}
+
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			if bpp == 24 {
+				p := row[x*3:]
+				c = color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+			} else {
+				v := binary.LittleEndian.Uint32(row[x*4:])
+				c = color.NRGBA{R: maskedByte(v, masks[0]), G: maskedByte(v, masks[1]), B: maskedByte(v, masks[2]), A: 0xff}
+				if masks[3] != 0 {
+					c.A = maskedByte(v, masks[3])
+				}
+			}
+			img.SetNRGBA(x, dy, c)
+		}
+	}
+	return img, nil
+}
+
+// maskedByte returns the 8-bit channel value of v selected by mask.
+func maskedByte(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := uint(0)
+	for mask&1 == 0 {
+		mask >>= 1
+		shift++
+	}
+	return uint8((v >> shift & mask) * 0xff / mask)
+}
+
+// decodePPM decodes a binary PPM (P6) or PGM (P5) image.
+func decodePPM(buf []byte) (image.Image, error) {
+	r := bufio.NewReader(bytes.NewReader(buf))
+
+	var fields [4]int
+	magic, err := readPNMToken(r)
+	if err != nil {
+		return nil, err
+	} else if magic != "P5" && magic != "P6" {
+		return nil, fmt.Errorf("%w: ppm header", ErrInvalidImage)
+	}
+	for i := 1; i < len(fields); i++ {
+		tok, err := readPNMToken(r)
+		if err != nil {
+			return nil, err
+		} else if _, err := fmt.Sscanf(tok, "%d", &fields[i]); err != nil {
+			return nil, fmt.Errorf("%w: ppm header", ErrInvalidImage)
+		}
+	}
+	width, height, maxval := fields[1], fields[2], fields[3]
+	if width <= 0 || height <= 0 || maxval <= 0 || maxval > 0xffff {
+		return nil, fmt.Errorf("%w: ppm dimensions", ErrInvalidImage)
+	}
+
+	channels, size := 3, 1
+	if magic == "P5" {
+		channels = 1
+	}
+	if maxval > 0xff {
+		size = 2
+	}
+	data := make([]byte, width*height*channels*size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: ppm data truncated", ErrInvalidImage)
+	}
+
+	// Samples are scaled from maxval to 8 bits.
+	sample := func(i int) uint8 {
+		v := int(data[i*size])
+		if size == 2 {
+			v = v<<8 | int(data[i*size+1])
+		}
+		return uint8(v * 0xff / maxval)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		c := color.NRGBA{A: 0xff}
+		if channels == 1 {
+			c.R = sample(i)
+			c.G, c.B = c.R, c.R
+		} else {
+			c.R, c.G, c.B = sample(i*3), sample(i*3+1), sample(i*3+2)
+		}
+		img.SetNRGBA(i%width, i/width, c)
+	}
+	return img, nil
+}
+
+// readPNMToken reads the next whitespace separated header token, skipping
+// comments. The single whitespace byte after the token is consumed.
+func readPNMToken(r *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("%w: ppm header", ErrInvalidImage)
+		}
+
+		switch {
+		case b == '#' && len(tok) == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("%w: ppm header", ErrInvalidImage)
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, b)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package phantomjs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure BMP and PPM renders can be decoded.
+func TestWebPage_RenderImage_Raster(t *testing.T) {
+	for _, tt := range []struct {
+		format phantomjs.RenderFormat
+		data   []byte
+	}{
+		{phantomjs.RenderFormatBMP, MustEncodeBMP(2, 2, false)},
+		{phantomjs.RenderFormatBMP, MustEncodeBMP(2, 2, true)},
+		{phantomjs.RenderFormatPPM, []byte("P6\n# comment\n2 2\n255\n\xff\x00\x00\x00\xff\x00\x00\x00\xff\xff\xff\xff")},
+	} {
+		tr := phantomjstest.NewTransport()
+		tr.Handle("/webpage/Render", func(req json.RawMessage) (interface{}, error) {
+			var v struct {
+				Filename string `json:"filename"`
+			}
+			if err := json.Unmarshal(req, &v); err != nil {
+				return nil, err
+			}
+			return nil, ioutil.WriteFile(v.Filename, tt.data, 0666)
+		})
+
+		p := tr.NewProcess()
+		if err := p.Open(); err != nil {
+			t.Fatal(err)
+		}
+		page, err := p.CreateWebPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := page.RenderImage(phantomjs.RenderOptions{Format: tt.format})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		} else if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+			t.Fatalf("%s: unexpected bounds: %v", tt.format, b)
+		}
+
+		// Pixels are red, green, blue and white from the top left.
+		for i, expected := range []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}} {
+			if c := color.NRGBAModel.Convert(img.At(i%2, i/2)).(color.NRGBA); c != expected {
+				t.Fatalf("%s: unexpected pixel(%d): %v", tt.format, i, c)
+			}
+		}
+
+		page.Close()
+		p.Close()
+	}
+}
+
+// Ensure truncated images return an error.
+func TestWebPage_RenderImage_Invalid(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.Handle("/webpage/Render", func(req json.RawMessage) (interface{}, error) {
+		var v struct {
+			Filename string `json:"filename"`
+		}
+		if err := json.Unmarshal(req, &v); err != nil {
+			return nil, err
+		}
+		return nil, ioutil.WriteFile(v.Filename, MustEncodeBMP(2, 2, false)[:60], 0666)
+	})
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	if _, err := page.RenderImage(phantomjs.RenderOptions{Format: phantomjs.RenderFormatBMP}); !errors.Is(err, phantomjs.ErrInvalidImage) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// MustEncodeBMP returns a 24-bit, or 32-bit top-down, BMP image with red,
+// green, blue and white pixels in row order.
+func MustEncodeBMP(width, height int, topDown32 bool) []byte {
+	pixels := [][3]byte{{255, 0, 0}, {0, 255, 0}, {0, 0, 255}, {255, 255, 255}}
+
+	bpp := 24
+	if topDown32 {
+		bpp = 32
+	}
+	stride := ((width*bpp + 31) / 32) * 4
+	data := make([]byte, stride*height)
+	for y := 0; y < height; y++ {
+		row := y
+		if !topDown32 {
+			row = height - 1 - y
+		}
+		for x := 0; x < width; x++ {
+			p := pixels[(y*width+x)%len(pixels)]
+			i := row*stride + x*bpp/8
+			data[i], data[i+1], data[i+2] = p[2], p[1], p[0]
+		}
+	}
+
+	h := int32(height)
+	if topDown32 {
+		h = -h
+	}
+	var buf bytes.Buffer
+	buf.WriteString("BM")
+	for _, v := range []interface{}{
+		uint32(54 + len(data)), uint32(0), uint32(54), // file header
+		uint32(40), int32(width), h, uint16(1), uint16(bpp), uint32(0), uint32(len(data)), int32(2835), int32(2835), uint32(0), uint32(0),
+	} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
@@ -0,0 +1,134 @@
+package phantomjs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrInvalidDevice is returned when emulating or registering a device with
+// a missing name, a non-positive size or a negative pixel ratio.
+var ErrInvalidDevice = errors.New("invalid device")
+
+// Device represents the screen and browser characteristics of a device.
+//
+// Width and Height are specified in CSS pixels. The page's viewport is
+// scaled by DevicePixelRatio so that rendered images match the resolution
+// of the device's screen.
+type Device struct {
+	Name             string
+	Width            int
+	Height           int
+	DevicePixelRatio float64
+	UserAgent        string
+	Touch            bool
+}
+
+// Validate returns an error if the device cannot be emulated.
+func (d Device) Validate() error {
+	if d.Name == "" || d.Width <= 0 || d.Height <= 0 || d.DevicePixelRatio < 0 {
+		return ErrInvalidDevice
+	}
+	return nil
+}
+
+// pixelRatio returns the device pixel ratio, defaulting to 1.
+func (d Device) pixelRatio() float64 {
+	if d.DevicePixelRatio == 0 {
+		return 1
+	}
+	return d.DevicePixelRatio
+}
+
+// User agents used by the built-in devices.
+const (
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 14_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1"
+	iPadUserAgent    = "Mozilla/5.0 (iPad; CPU OS 14_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36"
+	galaxyUserAgent  = "Mozilla/5.0 (Linux; Android 9; SM-G960F) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36"
+	desktopUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36"
+)
+
+var (
+	devicesMu sync.RWMutex
+	devices   = map[string]Device{}
+)
+
+func init() {
+	for _, d := range []Device{
+		{Name: "iPhone SE", Width: 375, Height: 667, DevicePixelRatio: 2, UserAgent: iPhoneUserAgent, Touch: true},
+		{Name: "iPhone 12", Width: 390, Height: 844, DevicePixelRatio: 3, UserAgent: iPhoneUserAgent, Touch: true},
+		{Name: "Pixel 5", Width: 393, Height: 851, DevicePixelRatio: 2.75, UserAgent: androidUserAgent, Touch: true},
+		{Name: "Galaxy S9", Width: 360, Height: 740, DevicePixelRatio: 3, UserAgent: galaxyUserAgent, Touch: true},
+		{Name: "iPad", Width: 768, Height: 1024, DevicePixelRatio: 2, UserAgent: iPadUserAgent, Touch: true},
+		{Name: "iPad Pro", Width: 1024, Height: 1366, DevicePixelRatio: 2, UserAgent: iPadUserAgent, Touch: true},
+		{Name: "Desktop", Width: 1366, Height: 768, DevicePixelRatio: 1, UserAgent: desktopUserAgent},
+		{Name: "Desktop HD", Width: 1920, Height: 1080, DevicePixelRatio: 1, UserAgent: desktopUserAgent},
+		{Name: "Desktop HiDPI", Width: 1440, Height: 900, DevicePixelRatio: 2, UserAgent: desktopUserAgent},
+	} {
+		devices[d.Name] = d
+	}
+}
+
+// RegisterDevice adds a device to the catalog so it can be found with
+// LookupDevice(). Registering a device with an existing name replaces it.
+func RegisterDevice(d Device) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	devices[d.Name] = d
+	return nil
+}
+
+// LookupDevice returns a device from the catalog by name.
+func LookupDevice(name string) (Device, bool) {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+	d, ok := devices[name]
+	return d, ok
+}
+
+// Devices returns all devices in the catalog, sorted by name.
+func Devices() []Device {
+	devicesMu.RLock()
+	defer devicesMu.RUnlock()
+
+	a := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		a = append(a, d)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+// Emulate configures the page to behave like device. The viewport, user agent
+// and zoom factor are set immediately. The device pixel ratio and touch
+// support are applied to the page's window on each navigation.
+func (p *WebPage) Emulate(device Device) error {
+	if err := device.Validate(); err != nil {
+		return err
+	}
+	return p.doJSON("/webpage/Emulate", map[string]interface{}{"ref": p.ref.id, "device": encodeDeviceJSON(device)}, nil)
+}
+
+// deviceJSON is a struct for encoding devices as JSON.
+type deviceJSON struct {
+	Width            int     `json:"width"`
+	Height           int     `json:"height"`
+	DevicePixelRatio float64 `json:"devicePixelRatio"`
+	UserAgent        string  `json:"userAgent,omitempty"`
+	Touch            bool    `json:"touch"`
+}
+
+func encodeDeviceJSON(d Device) deviceJSON {
+	return deviceJSON{
+		Width:            d.Width,
+		Height:           d.Height,
+		DevicePixelRatio: d.pixelRatio(),
+		UserAgent:        d.UserAgent,
+		Touch:            d.Touch,
+	}
+}
@@ -0,0 +1,74 @@
+package phantomjs_test
+
+import (
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure a page reports the emulated device's screen & user agent.
+func TestWebPage_Emulate(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	device, ok := phantomjs.LookupDevice("iPhone SE")
+	if !ok {
+		t.Fatal("expected device")
+	} else if err := page.Emulate(device); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><head><meta name="viewport" content="width=device-width"></head><body></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.EvaluateJavaScript(`function() { return window.innerWidth }`); err != nil {
+		t.Fatal(err)
+	} else if v != float64(375) {
+		t.Fatalf("unexpected width: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() { return window.devicePixelRatio }`); err != nil {
+		t.Fatal(err)
+	} else if v != float64(2) {
+		t.Fatalf("unexpected pixel ratio: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() { return "ontouchstart" in window }`); err != nil {
+		t.Fatal(err)
+	} else if v != true {
+		t.Fatalf("unexpected touch support: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() { return navigator.userAgent }`); err != nil {
+		t.Fatal(err)
+	} else if v != device.UserAgent {
+		t.Fatalf("unexpected user agent: %v", v)
+	}
+}
+
+// Ensure custom devices can be registered and looked up.
+func TestRegisterDevice(t *testing.T) {
+	device := phantomjs.Device{Name: "Kiosk", Width: 1080, Height: 1920, DevicePixelRatio: 1.5}
+	if err := phantomjs.RegisterDevice(device); err != nil {
+		t.Fatal(err)
+	} else if other, ok := phantomjs.LookupDevice("Kiosk"); !ok {
+		t.Fatal("expected device")
+	} else if other != device {
+		t.Fatalf("unexpected device: %#v", other)
+	}
+
+	// Registered devices should be listed with the built-in devices.
+	var found bool
+	for _, d := range phantomjs.Devices() {
+		found = found || d.Name == "Kiosk"
+	}
+	if !found {
+		t.Fatal("expected device in list")
+	}
+
+	// Invalid devices should not be registered.
+	if err := phantomjs.RegisterDevice(phantomjs.Device{Name: "Empty"}); err != phantomjs.ErrInvalidDevice {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, ok := phantomjs.LookupDevice("Empty"); ok {
+		t.Fatal("unexpected device")
+	}
+}
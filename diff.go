@@ -0,0 +1,319 @@
+package phantomjs
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"os"
+)
+
+// ErrImageSizeMismatch is returned when diffing images of different sizes.
+var ErrImageSizeMismatch = errors.New("image size mismatch")
+
+// DefaultDiffRegionMargin is the default distance, in pixels, within which
+// changed areas are merged into a single region.
+const DefaultDiffRegionMargin = 8
+
+// DiffOptions represents options for DiffImages().
+type DiffOptions struct {
+	// Maximum difference allowed for a single pixel, from 0 to 1. The
+	// difference is the largest change of any color channel.
+	Threshold float64
+
+	// If true, pixels that appear to be anti-aliased edges in either image
+	// are not counted as changed.
+	IgnoreAntiAliasing bool
+
+	// Areas of the images that are not compared, in pixels.
+	Ignore []image.Rectangle
+
+	// Distance, in pixels, within which changed areas are merged into one
+	// region. Defaults to DefaultDiffRegionMargin. Use a negative value to
+	// only merge touching pixels.
+	RegionMargin int
+}
+
+// DiffResult represents the difference between two images.
+type DiffResult struct {
+	// Number of pixels that differ and the fraction of compared pixels that
+	// differ, from 0 to 1.
+	ChangedPixels int
+	Score         float64
+
+	// Bounding boxes of the changed areas, relative to the image origin.
+	Regions []image.Rectangle
+
+	// Image highlighting changed pixels in red, ignored anti-aliased
+	// pixels in yellow and ignored areas in translucent blue over a faded
+	// copy of the first image.
+	Image *image.RGBA
+}
+
+// DiffImages compares a and b, such as two images returned by
+// WebPage.RenderImage(), and returns the changed pixels. Both images must be
+// the same size.
+func DiffImages(a, b image.Image, opt DiffOptions) (*DiffResult, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return nil, ErrImageSizeMismatch
+	}
+	w, h := ab.Dx(), ab.Dy()
+
+	// Normalize both images so they can be indexed from the origin.
+	img0, img1 := toNRGBA(a), toNRGBA(b)
+
+	result := &DiffResult{Image: image.NewRGBA(image.Rect(0, 0, w, h))}
+	changed := make([]bool, w*h)
+
+	var total int
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if inRects(image.Pt(x, y), opt.Ignore) {
+				result.Image.Set(x, y, color.NRGBA{0, 0, 255, 64})
+				continue
+			}
+			total++
+
+			c0, c1 := img0.NRGBAAt(x, y), img1.NRGBAAt(x, y)
+			switch {
+			case colorDistance(c0, c1) <= opt.Threshold:
+				// Fade matching pixels so changes stand out.
+				v := luma(c0) / 4
+				result.Image.Set(x, y, color.RGBA{v, v, v, 64})
+			case opt.IgnoreAntiAliasing && (antialiased(img0, img1, x, y) || antialiased(img1, img0, x, y)):
+				result.Image.Set(x, y, color.RGBA{255, 255, 0, 255})
+			default:
+				result.Image.Set(x, y, color.RGBA{255, 0, 0, 255})
+				changed[y*w+x] = true
+				result.ChangedPixels++
+			}
+		}
+	}
+	if total > 0 {
+		result.Score = float64(result.ChangedPixels) / float64(total)
+	}
+
+	margin := opt.RegionMargin
+	if margin == 0 {
+		margin = DefaultDiffRegionMargin
+	} else if margin < 0 {
+		margin = 0
+	}
+	result.Regions = diffRegions(changed, w, h, margin)
+
+	return result, nil
+}
+
+// DiffImageFiles decodes the images at path0 and path1, such as two files
+// written by WebPage.Render(), and compares them with DiffImages().
+func DiffImageFiles(path0, path1 string, opt DiffOptions) (*DiffResult, error) {
+	a, err := readImageFile(path0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readImageFile(path1)
+	if err != nil {
+		return nil, err
+	}
+	return DiffImages(a, b, opt)
+}
+
+// readImageFile reads and decodes an image file.
+func readImageFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// toNRGBA returns img as an NRGBA image with its origin at zero.
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if img, ok := img.(*image.NRGBA); ok && b.Min == (image.Point{}) {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// colorDistance returns the largest channel difference between a and b,
+// from 0 to 1.
+func colorDistance(a, b color.NRGBA) float64 {
+	var max uint8
+	for _, d := range []uint8{absDiff(a.R, b.R), absDiff(a.G, b.G), absDiff(a.B, b.B), absDiff(a.A, b.A)} {
+		if d > max {
+			max = d
+		}
+	}
+	return float64(max) / 0xff
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// luma returns the brightness of c blended over a white background.
+func luma(c color.NRGBA) uint8 {
+	blend := func(v uint8) float64 { return 255 + (float64(v)-255)*float64(c.A)/255 }
+	return uint8(0.299*blend(c.R) + 0.587*blend(c.G) + 0.114*blend(c.B) + 0.5)
+}
+
+// antialiased returns true if the pixel at (x, y) in img appears to be an
+// anti-aliased edge. A pixel is anti-aliased if it sits between a darker and
+// a brighter neighbor and either of those neighbors belongs to a solid area
+// in both images.
+func antialiased(img, other *image.NRGBA, x, y int) bool {
+	b := img.Bounds()
+	x0, y0 := maxInt(x-1, 0), maxInt(y-1, 0)
+	x1, y1 := minInt(x+1, b.Dx()-1), minInt(y+1, b.Dy()-1)
+
+	// Edge pixels have fewer neighbors so count the missing ones as equal.
+	var zeroes int
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+
+	center := int(luma(img.NRGBAAt(x, y)))
+	var min, max int
+	var minX, minY, maxX, maxY int
+	for ny := y0; ny <= y1; ny++ {
+		for nx := x0; nx <= x1; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+
+			delta := int(luma(img.NRGBAAt(nx, ny))) - center
+			if delta == 0 {
+				if zeroes++; zeroes > 2 {
+					return false
+				}
+			} else if delta < min {
+				min, minX, minY = delta, nx, ny
+			} else if delta > max {
+				max, maxX, maxY = delta, nx, ny
+			}
+		}
+	}
+
+	// Anti-aliased pixels have both darker and brighter neighbors.
+	if min == 0 || max == 0 {
+		return false
+	}
+	return (hasManySiblings(img, minX, minY) && hasManySiblings(other, minX, minY)) ||
+		(hasManySiblings(img, maxX, maxY) && hasManySiblings(other, maxX, maxY))
+}
+
+// hasManySiblings returns true if the pixel at (x, y) has more than two
+// neighbors with exactly the same color.
+func hasManySiblings(img *image.NRGBA, x, y int) bool {
+	b := img.Bounds()
+	x0, y0 := maxInt(x-1, 0), maxInt(y-1, 0)
+	x1, y1 := minInt(x+1, b.Dx()-1), minInt(y+1, b.Dy()-1)
+
+	var zeroes int
+	if x == x0 || x == x1 || y == y0 || y == y1 {
+		zeroes = 1
+	}
+
+	c := img.NRGBAAt(x, y)
+	for ny := y0; ny <= y1; ny++ {
+		for nx := x0; nx <= x1; nx++ {
+			if nx == x && ny == y {
+				continue
+			}
+			if img.NRGBAAt(nx, ny) == c {
+				if zeroes++; zeroes > 2 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// diffRegions returns the bounding boxes of connected changed pixels. Boxes
+// within margin pixels of each other are merged.
+func diffRegions(changed []bool, w, h, margin int) []image.Rectangle {
+	var regions []image.Rectangle
+	visited := make([]bool, len(changed))
+
+	// Find the bounds of each 8-connected group of changed pixels.
+	for i := range changed {
+		if !changed[i] || visited[i] {
+			continue
+		}
+
+		r := image.Rect(i%w, i/w, i%w+1, i/w+1)
+		stack := []int{i}
+		visited[i] = true
+		for len(stack) > 0 {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := j%w, j/w
+			r = r.Union(image.Rect(x, y, x+1, y+1))
+
+			for ny := maxInt(y-1, 0); ny <= minInt(y+1, h-1); ny++ {
+				for nx := maxInt(x-1, 0); nx <= minInt(x+1, w-1); nx++ {
+					if k := ny*w + nx; changed[k] && !visited[k] {
+						visited[k] = true
+						stack = append(stack, k)
+					}
+				}
+			}
+		}
+		regions = append(regions, r)
+	}
+
+	// Merge regions that are near each other until no more can be merged.
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(regions); i++ {
+			for j := i + 1; j < len(regions); j++ {
+				if regions[i].Inset(-margin).Overlaps(regions[j]) {
+					regions[i] = regions[i].Union(regions[j])
+					regions = append(regions[:j], regions[j+1:]...)
+					merged = true
+					j--
+				}
+			}
+		}
+	}
+	return regions
+}
+
+// inRects returns true if pt is within any of the rectangles.
+func inRects(pt image.Point, rects []image.Rectangle) bool {
+	for _, r := range rects {
+		if pt.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package phantomjs_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure identical images have no differences.
+func TestDiffImages_Identical(t *testing.T) {
+	a, b := NewSolidImage(10, 10, color.White), NewSolidImage(10, 10, color.White)
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{}); err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels != 0 || result.Score != 0 || len(result.Regions) != 0 {
+		t.Fatalf("unexpected result: %d, %f, %v", result.ChangedPixels, result.Score, result.Regions)
+	} else if result.Image.Bounds() != image.Rect(0, 0, 10, 10) {
+		t.Fatalf("unexpected diff image bounds: %v", result.Image.Bounds())
+	}
+}
+
+// Ensure changed areas are reported as scored, merged regions.
+func TestDiffImages_Regions(t *testing.T) {
+	a, b := NewSolidImage(100, 100, color.White), NewSolidImage(100, 100, color.White)
+	draw.Draw(b, image.Rect(10, 10, 20, 20), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(b, image.Rect(22, 10, 25, 15), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(b, image.Rect(70, 70, 80, 75), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels != 165 {
+		t.Fatalf("unexpected changed pixels: %d", result.ChangedPixels)
+	} else if result.Score != 0.0165 {
+		t.Fatalf("unexpected score: %f", result.Score)
+	} else if !reflect.DeepEqual(result.Regions, []image.Rectangle{image.Rect(10, 10, 25, 20), image.Rect(70, 70, 80, 75)}) {
+		t.Fatalf("unexpected regions: %v", result.Regions)
+	} else if c := result.Image.RGBAAt(15, 15); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Fatalf("unexpected diff color: %v", c)
+	}
+
+	// Nearby regions should not be merged without a margin.
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{RegionMargin: -1}); err != nil {
+		t.Fatal(err)
+	} else if len(result.Regions) != 3 {
+		t.Fatalf("unexpected regions: %v", result.Regions)
+	}
+}
+
+// Ensure small differences within the threshold and ignored areas are not counted.
+func TestDiffImages_ThresholdAndIgnore(t *testing.T) {
+	a, b := NewSolidImage(10, 10, color.White), NewSolidImage(10, 10, color.White)
+	b.Set(1, 1, color.RGBA{250, 250, 250, 255})
+	b.Set(8, 8, color.Black)
+
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{
+		Threshold: 0.1,
+		Ignore:    []image.Rectangle{image.Rect(8, 8, 9, 9)},
+	}); err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels != 0 {
+		t.Fatalf("unexpected changed pixels: %d", result.ChangedPixels)
+	} else if c := result.Image.RGBAAt(8, 8); c != (color.RGBA{0, 0, 64, 64}) {
+		t.Fatalf("unexpected ignored color: %v", c)
+	}
+
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{}); err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels != 2 {
+		t.Fatalf("unexpected changed pixels: %d", result.ChangedPixels)
+	}
+}
+
+// Ensure anti-aliased edges can be ignored.
+func TestDiffImages_IgnoreAntiAliasing(t *testing.T) {
+	// Draw a black block with a gray edge that shifts between images.
+	a, b := NewSolidImage(20, 20, color.White), NewSolidImage(20, 20, color.White)
+	draw.Draw(a, image.Rect(5, 5, 10, 15), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(b, image.Rect(5, 5, 10, 15), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(a, image.Rect(10, 5, 11, 15), image.NewUniform(color.Gray{128}), image.Point{}, draw.Src)
+	draw.Draw(b, image.Rect(10, 5, 11, 15), image.NewUniform(color.Gray{96}), image.Point{}, draw.Src)
+
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{}); err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels == 0 {
+		t.Fatal("expected changed pixels")
+	}
+
+	if result, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{IgnoreAntiAliasing: true}); err != nil {
+		t.Fatal(err)
+	} else if result.ChangedPixels != 0 {
+		t.Fatalf("unexpected changed pixels: %d", result.ChangedPixels)
+	}
+}
+
+// Ensure images of different sizes cannot be compared.
+func TestDiffImages_ErrImageSizeMismatch(t *testing.T) {
+	a, b := NewSolidImage(10, 10, color.White), NewSolidImage(10, 11, color.White)
+	if _, err := phantomjs.DiffImages(a, b, phantomjs.DiffOptions{}); err != phantomjs.ErrImageSizeMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// NewSolidImage returns an image of the given size filled with c.
+func NewSolidImage(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
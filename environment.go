@@ -0,0 +1,263 @@
+package phantomjs
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrInvalidGeolocation is returned when a latitude is not between -90 and 90,
+// a longitude is not between -180 and 180 or the accuracy is negative.
+var ErrInvalidGeolocation = errors.New("invalid geolocation")
+
+// EnvironmentOptions represents overrides for the clock, time zone, locale and
+// location reported to scripts on a page. Zero values leave the page's
+// environment unchanged.
+type EnvironmentOptions struct {
+	// Time reported by Date when the page is initialized. If FreezeTime is
+	// set then the clock does not advance.
+	Time       time.Time
+	FreezeTime bool
+
+	// Time zone used by Date's local time getters, setters and string
+	// methods. The UTC offset is calculated once, at Time or the current
+	// time, so daylight saving transitions are not applied. Strings parsed by
+	// Date.parse() still use the time zone of the host machine and the
+	// toLocale*String() methods ignore their arguments and use the en-US
+	// format.
+	Location *time.Location
+
+	// Values for navigator.language and navigator.languages.
+	// The first language is used as navigator.language.
+	Languages []string
+
+	// Position returned by navigator.geolocation.
+	Geolocation *Geolocation
+}
+
+// Validate returns an error if the options are invalid.
+func (opt *EnvironmentOptions) Validate() error {
+	if opt.Geolocation != nil {
+		return opt.Geolocation.Validate()
+	}
+	return nil
+}
+
+// Geolocation represents a position reported by navigator.geolocation.
+type Geolocation struct {
+	Latitude  float64
+	Longitude float64
+	Accuracy  float64 // in meters
+}
+
+// Validate returns an error if the position is out of range.
+func (g *Geolocation) Validate() error {
+	if g.Latitude < -90 || g.Latitude > 90 || g.Longitude < -180 || g.Longitude > 180 || g.Accuracy < 0 {
+		return ErrInvalidGeolocation
+	}
+	return nil
+}
+
+// SetEnvironment overrides the clock, time zone, locale and geolocation seen
+// by scripts on the page. The overrides are installed with AddInitScript() so
+// they apply to every navigation and are removed by Reset(). This should be
+// called once, before opening the page.
+func (p *WebPage) SetEnvironment(opt EnvironmentOptions) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+
+	script, err := encodeEnvironmentScript(opt)
+	if err != nil {
+		return err
+	}
+	return p.AddInitScript(script)
+}
+
+// encodeEnvironmentScript returns the init script that applies opt.
+func encodeEnvironmentScript(opt EnvironmentOptions) (string, error) {
+	var config environmentJSON
+	if !opt.Time.IsZero() {
+		ms := opt.Time.UnixNano() / int64(time.Millisecond)
+		config.Time, config.FreezeTime = &ms, opt.FreezeTime
+	}
+	if opt.Location != nil {
+		t := opt.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		_, offset := t.In(opt.Location).Zone()
+		minutes := -offset / 60
+		config.TimezoneOffset = &minutes
+	}
+	config.Languages = opt.Languages
+	if g := opt.Geolocation; g != nil {
+		config.Geolocation = &geolocationJSON{Latitude: g.Latitude, Longitude: g.Longitude, Accuracy: g.Accuracy}
+	}
+
+	buf, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return "(" + environmentScript + ")(" + string(buf) + ");", nil
+}
+
+// environmentJSON is the configuration passed to the environment init script.
+type environmentJSON struct {
+	Time           *int64           `json:"time"`
+	FreezeTime     bool             `json:"freezeTime"`
+	TimezoneOffset *int             `json:"timezoneOffset"` // minutes, as getTimezoneOffset()
+	Languages      []string         `json:"languages"`
+	Geolocation    *geolocationJSON `json:"geolocation"`
+}
+
+type geolocationJSON struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy"`
+}
+
+// environmentScript is the init script function used by SetEnvironment().
+// It is called with the JSON encoded configuration.
+const environmentScript = `function(config) {
+	// Defines a getter, falling back for objects that reject defineProperty().
+	var define = function(obj, name, fn) {
+		try {
+			Object.defineProperty(obj, name, {get: fn, configurable: true});
+		} catch(e) {
+			obj.__defineGetter__(name, fn);
+		}
+	};
+
+	var RealDate = Date;
+	var offset = config.timezoneOffset;
+
+	// Replace the clock with a fixed or offset time.
+	if (config.time !== null || offset !== null) {
+		var start = RealDate.now();
+		var now = function() {
+			if (config.time === null) {
+				return RealDate.now();
+			} else if (config.freezeTime) {
+				return config.time;
+			}
+			return config.time + (RealDate.now() - start);
+		};
+
+		var FakeDate = function(year, month, day, hours, minutes, seconds, ms) {
+			if (!(this instanceof FakeDate)) {
+				return new FakeDate().toString();
+			}
+			switch (arguments.length) {
+			case 0:
+				return new RealDate(now());
+			case 1:
+				return new RealDate(year);
+			}
+
+			// Local time components are converted using the fixed offset.
+			day = (day === undefined ? 1 : day);
+			if (offset === null) {
+				return new RealDate(year, month, day, hours || 0, minutes || 0, seconds || 0, ms || 0);
+			}
+			return new RealDate(RealDate.UTC(year, month, day, hours || 0, minutes || 0, seconds || 0, ms || 0) + offset * 60000);
+		};
+		FakeDate.prototype = RealDate.prototype;
+		FakeDate.now = now;
+		FakeDate.UTC = RealDate.UTC;
+		FakeDate.parse = RealDate.parse;
+		window.Date = FakeDate;
+	}
+
+	// Compute local time fields from UTC using the fixed offset.
+	if (offset !== null) {
+		var proto = RealDate.prototype;
+		var local = function(d) { return new RealDate(d.getTime() - offset * 60000); };
+		['FullYear', 'Month', 'Date', 'Day', 'Hours', 'Minutes', 'Seconds', 'Milliseconds'].forEach(function(name) {
+			var fn = proto['getUTC' + name];
+			proto['get' + name] = function() { return fn.call(local(this)); };
+		});
+		proto.getTimezoneOffset = function() { return offset; };
+
+		// Apply local time fields by setting the UTC fields of the shifted
+		// time and shifting back. Setters return the new time, like Date.
+		['FullYear', 'Month', 'Date', 'Hours', 'Minutes', 'Seconds', 'Milliseconds'].forEach(function(name) {
+			var fn = proto['setUTC' + name];
+			proto['set' + name] = function() {
+				var d = local(this);
+				if (name === 'FullYear' && isNaN(d.getTime())) {
+					d = new RealDate(0);
+				}
+				fn.apply(d, arguments);
+				return this.setTime(d.getTime() + offset * 60000);
+			};
+		});
+
+		var pad = function(n, width) {
+			n = String(n);
+			while (n.length < width) { n = '0' + n; }
+			return n;
+		};
+		var days = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat'];
+		var months = ['Jan', 'Feb', 'Mar', 'Apr', 'May', 'Jun', 'Jul', 'Aug', 'Sep', 'Oct', 'Nov', 'Dec'];
+		var zone = 'GMT' + (offset <= 0 ? '+' : '-') + pad(Math.floor(Math.abs(offset) / 60), 2) + pad(Math.abs(offset) % 60, 2);
+		proto.toDateString = function() {
+			return days[this.getDay()] + ' ' + months[this.getMonth()] + ' ' + pad(this.getDate(), 2) + ' ' + this.getFullYear();
+		};
+		proto.toTimeString = function() {
+			return pad(this.getHours(), 2) + ':' + pad(this.getMinutes(), 2) + ':' + pad(this.getSeconds(), 2) + ' ' + zone;
+		};
+		proto.toString = function() {
+			return this.toDateString() + ' ' + this.toTimeString();
+		};
+
+		// Locale strings always use the en-US format since the host's
+		// formatting would apply its own time zone.
+		proto.toLocaleDateString = function() {
+			return (this.getMonth() + 1) + '/' + this.getDate() + '/' + this.getFullYear();
+		};
+		proto.toLocaleTimeString = function() {
+			var hours = this.getHours() % 12 || 12;
+			return hours + ':' + pad(this.getMinutes(), 2) + ':' + pad(this.getSeconds(), 2) + ' ' + (this.getHours() < 12 ? 'AM' : 'PM');
+		};
+		proto.toLocaleString = function() {
+			return this.toLocaleDateString() + ', ' + this.toLocaleTimeString();
+		};
+	}
+
+	// Override the preferred languages.
+	if (config.languages && config.languages.length > 0) {
+		define(navigator, 'language', function() { return config.languages[0]; });
+		define(navigator, 'languages', function() { return config.languages.slice(); });
+	}
+
+	// Report a fixed position. Callbacks are invoked asynchronously.
+	if (config.geolocation) {
+		var position = function() {
+			return {
+				coords: {
+					latitude: config.geolocation.latitude,
+					longitude: config.geolocation.longitude,
+					accuracy: config.geolocation.accuracy,
+					altitude: null,
+					altitudeAccuracy: null,
+					heading: null,
+					speed: null
+				},
+				timestamp: Date.now()
+			};
+		};
+		var watchID = 0;
+		var geolocation = {
+			getCurrentPosition: function(success) {
+				setTimeout(function() { success(position()); }, 0);
+			},
+			watchPosition: function(success) {
+				setTimeout(function() { success(position()); }, 0);
+				return ++watchID;
+			},
+			clearWatch: function() {}
+		};
+		define(navigator, 'geolocation', function() { return geolocation; });
+	}
+}`
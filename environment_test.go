@@ -0,0 +1,140 @@
+package phantomjs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure page scripts see the overridden clock, time zone, locale and location.
+func TestWebPage_SetEnvironment(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	now := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	if err := page.SetEnvironment(phantomjs.EnvironmentOptions{
+		Time:        now,
+		FreezeTime:  true,
+		Location:    time.FixedZone("EET", 2*60*60),
+		Languages:   []string{"fr-FR", "fr"},
+		Geolocation: &phantomjs.Geolocation{Latitude: 48.8566, Longitude: 2.3522, Accuracy: 10},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the geolocation result to the title once it is available.
+	if err := page.SetContent(`<html><body><script>
+		navigator.geolocation.getCurrentPosition(function(pos) {
+			document.title = pos.coords.latitude + "," + pos.coords.longitude;
+		});
+	</script></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := page.EvaluateJavaScript(`function() { return Date.now() }`); err != nil {
+		t.Fatal(err)
+	} else if v != float64(now.UnixNano()/int64(time.Millisecond)) {
+		t.Fatalf("unexpected time: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() { var d = new Date(); return [d.getHours(), d.getTimezoneOffset()].join(",") }`); err != nil {
+		t.Fatal(err)
+	} else if v != "5,-120" {
+		t.Fatalf("unexpected local time: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() { return navigator.language + "," + navigator.languages.join("|") }`); err != nil {
+		t.Fatal(err)
+	} else if v != "fr-FR,fr-FR|fr" {
+		t.Fatalf("unexpected languages: %v", v)
+	}
+
+	// Geolocation callbacks are asynchronous so wait for the title to change.
+	var title string
+	for i := 0; i < 50 && title == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		if title, err = page.Title(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if title != "48.8566,2.3522" {
+		t.Fatalf("unexpected geolocation: %q", title)
+	}
+}
+
+// Ensure local time setters and locale strings use the overridden time zone.
+func TestWebPage_SetEnvironment_Setters(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.SetEnvironment(phantomjs.EnvironmentOptions{
+		Time:       time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC),
+		FreezeTime: true,
+		Location:   time.FixedZone("EET", 2*60*60),
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local fields should round trip through their setters.
+	if v, err := page.EvaluateJavaScript(`function() {
+		var d = new Date();
+		d.setHours(d.getHours() + 1);
+		d.setMinutes(d.getMinutes(), d.getSeconds(), d.getMilliseconds());
+		d.setDate(d.getDate());
+		d.setFullYear(d.getFullYear(), d.getMonth());
+		return d.toISOString() + "," + d.getHours();
+	}`); err != nil {
+		t.Fatal(err)
+	} else if v != "2020-01-02T04:04:05.000Z,6" {
+		t.Fatalf("unexpected round trip: %v", v)
+	}
+
+	// Setting the local time should be relative to the overridden zone.
+	if v, err := page.EvaluateJavaScript(`function() {
+		var d = new Date();
+		d.setHours(23, 30, 0, 0);
+		return d.toISOString() + "," + d.toLocaleString();
+	}`); err != nil {
+		t.Fatal(err)
+	} else if v != "2020-01-02T21:30:00.000Z,1/2/2020, 11:30:00 PM" {
+		t.Fatalf("unexpected local time: %v", v)
+	}
+	if v, err := page.EvaluateJavaScript(`function() {
+		var d = new Date();
+		return d.toLocaleDateString() + "|" + d.toLocaleTimeString();
+	}`); err != nil {
+		t.Fatal(err)
+	} else if v != "1/2/2020|5:04:05 AM" {
+		t.Fatalf("unexpected locale strings: %v", v)
+	}
+}
+
+// Ensure out of range positions are rejected.
+func TestEnvironmentOptions_Validate(t *testing.T) {
+	for _, g := range []phantomjs.Geolocation{
+		{Latitude: 91},
+		{Latitude: -91},
+		{Longitude: 181},
+		{Longitude: -181},
+		{Accuracy: -1},
+	} {
+		g := g
+		opt := phantomjs.EnvironmentOptions{Geolocation: &g}
+		if err := opt.Validate(); err != phantomjs.ErrInvalidGeolocation {
+			t.Fatalf("unexpected error for %#v: %v", g, err)
+		}
+	}
+
+	opt := phantomjs.EnvironmentOptions{Geolocation: &phantomjs.Geolocation{Latitude: -90, Longitude: 180}}
+	if err := opt.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
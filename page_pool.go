@@ -0,0 +1,86 @@
+package phantomjs
+
+import (
+	"sync"
+)
+
+// DefaultMaxIdlePages is the default number of idle pages kept by a PagePool.
+const DefaultMaxIdlePages = 8
+
+// PagePool maintains a set of reusable web pages on a single process.
+//
+// Pages are reset with WebPage.Reset() when they are released so they can be
+// safely reused by unrelated work without the cost of creating a new page.
+// Each page uses its own cookie jar so releasing a page does not clear the
+// cookies of other pages in the process.
+type PagePool struct {
+	mu      sync.Mutex
+	process *Process
+	idle    []*WebPage
+	closed  bool
+
+	// Maximum number of idle pages to keep.
+	// Released pages are closed once this limit is reached.
+	MaxIdle int
+}
+
+// NewPagePool returns a new instance of PagePool that creates pages on process.
+func NewPagePool(process *Process) *PagePool {
+	return &PagePool{
+		process: process,
+		MaxIdle: DefaultMaxIdlePages,
+	}
+}
+
+// Acquire returns an idle page from the pool or creates a new page if none
+// are available.
+func (p *PagePool) Acquire() (*WebPage, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	} else if n := len(p.idle); n > 0 {
+		page := p.idle[n-1]
+		p.idle[n-1], p.idle = nil, p.idle[:n-1]
+		p.mu.Unlock()
+		return page, nil
+	}
+	p.mu.Unlock()
+
+	return p.process.CreateWebPageWithOptions(WebPageOptions{IsolateCookies: true})
+}
+
+// Release resets page and returns it to the pool. If the pool already has
+// MaxIdle pages, or the page cannot be reset, then the page is closed.
+func (p *PagePool) Release(page *WebPage) error {
+	if err := page.Reset(); err != nil {
+		page.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.MaxIdle {
+		p.idle = append(p.idle, page)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	return page.Close()
+}
+
+// Close closes all idle pages. Pages that are currently acquired are closed
+// when they are released.
+func (p *PagePool) Close() (err error) {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	for _, page := range idle {
+		if e := page.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package phantomjs_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure page pool reuses released pages after resetting their state.
+func TestPagePool_Release(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	pool := phantomjs.NewPagePool(p.Process)
+	defer pool.Close()
+
+	// Acquire a page and modify its state.
+	page, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetCustomHeaders(http.Header{"X-Foo": []string{"bar"}}); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetZoomFactor(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Release(page); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acquire again and verify the same page is returned with default state.
+	other, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release(other)
+
+	if other != page {
+		t.Fatal("expected page to be reused")
+	}
+	if content, err := other.Content(); err != nil {
+		t.Fatal(err)
+	} else if content != `<html><head></head><body></body></html>` {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	if width, height, err := other.ViewportSize(); err != nil {
+		t.Fatal(err)
+	} else if width != 400 || height != 300 {
+		t.Fatalf("unexpected viewport: %dx%d", width, height)
+	}
+	if hdr, err := other.CustomHeaders(); err != nil {
+		t.Fatal(err)
+	} else if len(hdr) != 0 {
+		t.Fatalf("unexpected headers: %#v", hdr)
+	}
+	if v, err := other.ZoomFactor(); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Fatalf("unexpected zoom factor: %v", v)
+	}
+}
+
+// Ensure page pool closes pages beyond the idle limit.
+func TestPagePool_Release_MaxIdle(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	pool := phantomjs.NewPagePool(p.Process)
+	pool.MaxIdle = 1
+	defer pool.Close()
+
+	page0, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.Release(page0); err != nil {
+		t.Fatal(err)
+	} else if err := pool.Release(page1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first released page should be reused.
+	if page, err := pool.Acquire(); err != nil {
+		t.Fatal(err)
+	} else if page != page0 {
+		t.Fatal("expected first page to be reused")
+	} else if err := pool.Release(page); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure releasing a pooled page does not clear cookies set by other pages.
+func TestPagePool_Release_Cookies(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	pool := phantomjs.NewPagePool(p.Process)
+	defer pool.Close()
+
+	page0, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release(page0)
+	page1, err := pool.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add cookies to the process and the first page.
+	if _, err := p.AddCookie(&http.Cookie{Domain: ".example1.com", Name: "PROCESS", Path: "/", Value: "VALUE"}); err != nil {
+		t.Fatal(err)
+	} else if _, err := page0.AddCookie(&http.Cookie{Domain: ".example1.com", Name: "PAGE", Path: "/", Value: "VALUE"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Release the second page.
+	if err := pool.Release(page1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cookies on the first page and the process should remain.
+	if cookies, err := page0.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "PAGE" {
+		t.Fatalf("unexpected page cookies: %#v", cookies)
+	}
+	if cookies, err := p.Cookies(); err != nil {
+		t.Fatal(err)
+	} else if len(cookies) != 1 || cookies[0].Name != "PROCESS" {
+		t.Fatalf("unexpected process cookies: %#v", cookies)
+	}
+}
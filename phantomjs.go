@@ -2,21 +2,79 @@ package phantomjs
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"  // register GIF decoder for RenderImage
+	_ "image/jpeg" // register JPEG decoder for RenderImage
+	_ "image/png"  // register PNG decoder for RenderImage
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	// ErrInjectionFailed is returned by InjectJS when injection fails.
 	ErrInjectionFailed = errors.New("injection failed")
+
+	// ErrProcessNotOpen is returned when sending a request to a process
+	// that has not been opened or has been closed.
+	ErrProcessNotOpen = errors.New("process not open")
+
+	// ErrProcessExited is matched by errors returned by a transport when the
+	// process can no longer be reached, such as after it crashes or is killed.
+	ErrProcessExited = errors.New("process exited")
+
+	// ErrRefNotFound is matched by a RemoteError when the process has no
+	// object for the requested reference.
+	ErrRefNotFound = errors.New("ref not found")
+
+	// ErrPageClosed is returned when calling a method on a web page that
+	// has been closed or released.
+	ErrPageClosed = errors.New("page closed")
+
+	// ErrInvalidRenderFormat is returned when an unsupported render format is used.
+	ErrInvalidRenderFormat = errors.New("invalid render format")
+
+	// ErrInvalidRenderQuality is returned when the render quality is not between 0 and 100.
+	ErrInvalidRenderQuality = errors.New("invalid render quality")
+
+	// ErrInvalidClipRect is returned when a clipping rectangle has no area.
+	ErrInvalidClipRect = errors.New("invalid clip rect")
+
+	// ErrInvalidZoomFactor is returned when a negative zoom factor is used.
+	ErrInvalidZoomFactor = errors.New("invalid zoom factor")
+
+	// ErrRenderFormatNotSupported is returned when a format cannot be used
+	// by a specific render function, such as PDF with RenderImage().
+	ErrRenderFormatNotSupported = errors.New("render format not supported")
+
+	// ErrInvalidPadding is returned when a negative padding is used.
+	ErrInvalidPadding = errors.New("invalid padding")
+
+	// ErrElementNotFound is returned when a selector does not match any element.
+	ErrElementNotFound = errors.New("element not found")
+
+	// ErrFullPageConflict is returned when a full page render also specifies
+	// a clipping rectangle or viewport-only rendering.
+	ErrFullPageConflict = errors.New("full page render cannot be combined with clip rect or viewport")
+
+	// ErrInvalidMaxHeight is returned when a negative maximum height is used.
+	ErrInvalidMaxHeight = errors.New("invalid max height")
 )
 
 // Keyboard modifiers.
@@ -32,6 +90,12 @@ const (
 const (
 	DefaultPort    = 20202
 	DefaultBinPath = "phantomjs"
+
+	// Maximum height, in pixels, rendered by a full page render.
+	DefaultFullPageMaxHeight = 16384
+
+	// Time to wait for pending resources after scrolling a full page render.
+	DefaultSettleTimeout = 5 * time.Second
 )
 
 // Process represents a PhantomJS process.
@@ -39,6 +103,12 @@ type Process struct {
 	path string
 	cmd  *exec.Cmd
 
+	token string // shared secret required by the shim
+
+	mu     sync.Mutex
+	opened bool
+	pages  map[string]string // open web page refs by creation location
+
 	// Path to the 'phantomjs' binary.
 	BinPath string
 
@@ -48,6 +118,10 @@ type Process struct {
 	// Output from the process.
 	Stdout io.Writer
 	Stderr io.Writer
+
+	// Transport used to start & communicate with the shim script.
+	// Defaults to an HTTPTransport if nil when the process is opened.
+	Transport Transport
 }
 
 // NewProcess returns a new instance of Process.
@@ -76,23 +150,26 @@ func (p *Process) Open() error {
 		p.path = path
 
 		// Write shim script.
-		scriptPath := filepath.Join(path, "shim.js")
-		if err := ioutil.WriteFile(scriptPath, []byte(shim), 0600); err != nil {
+		if err := ioutil.WriteFile(p.scriptPath(), []byte(shim), 0600); err != nil {
 			return err
 		}
 
-		// Start external process.
-		cmd := exec.Command(p.BinPath, scriptPath)
-		cmd.Env = []string{fmt.Sprintf("PORT=%d", p.Port)}
-		cmd.Stdout = p.Stdout
-		cmd.Stderr = p.Stderr
-		if err := cmd.Start(); err != nil {
+		// Generate a token so only this process can send requests to the shim.
+		token, err := generateToken()
+		if err != nil {
 			return err
 		}
-		p.cmd = cmd
+		p.token = token
 
-		// Wait until process is available.
-		if err := p.wait(); err != nil {
+		// Start the process & wait until it is available.
+		p.mu.Lock()
+		if p.Transport == nil {
+			p.Transport = NewHTTPTransport()
+		}
+		transport := p.Transport
+		p.mu.Unlock()
+
+		if err := transport.Open(p); err != nil {
 			return err
 		}
 		return nil
@@ -102,11 +179,76 @@ func (p *Process) Open() error {
 		return err
 	}
 
+	p.mu.Lock()
+	p.opened = true
+	p.mu.Unlock()
+	return nil
+}
+
+// Token returns the secret that must accompany every request to the shim.
+// It is generated each time the process is opened and is passed to the
+// shim through the TOKEN environment variable.
+func (p *Process) Token() string {
+	return p.token
+}
+
+// Pid returns the operating system process id of the phantomjs binary.
+// Returns zero if the process has not been started.
+func (p *Process) Pid() int {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// generateToken returns a random, hex-encoded token.
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// scriptPath returns the path to the shim script.
+func (p *Process) scriptPath() string {
+	return filepath.Join(p.path, "shim.js")
+}
+
+// start executes the phantomjs binary with the shim script and env.
+// The process is stopped by Close().
+func (p *Process) start(env []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.Command(p.BinPath, p.scriptPath())
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = p.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
 	return nil
 }
 
 // Close stops the process.
+//
+// If any web pages created by the process were never closed then a report
+// listing where each was created is written to Stderr.
 func (p *Process) Close() (err error) {
+	p.mu.Lock()
+	p.opened = false
+	transport := p.Transport
+	p.mu.Unlock()
+
+	p.reportLeaks()
+
+	// Close transport.
+	if transport != nil {
+		if e := transport.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
 	// Kill process.
 	if p.cmd != nil {
 		if e := p.cmd.Process.Kill(); e != nil && err == nil {
@@ -127,104 +269,204 @@ func (p *Process) Close() (err error) {
 
 // URL returns the process' API URL.
 func (p *Process) URL() string {
-	return fmt.Sprintf("http://localhost:%d", p.Port)
+	return fmt.Sprintf("http://127.0.0.1:%d", p.Port)
 }
 
-// wait continually checks the process until it gets a response or times out.
-func (p *Process) wait() error {
-	ticker := time.NewTicker(1000 * time.Millisecond)
-	defer ticker.Stop()
+// CreateWebPage returns a new instance of a "webpage".
+func (p *Process) CreateWebPage() (*WebPage, error) {
+	var resp struct {
+		Ref refJSON `json:"ref"`
+	}
+	if err := p.doJSON("/webpage/Create", nil, &resp); err != nil {
+		return nil, err
+	}
 
-	timer := time.NewTimer(30 * time.Second)
-	defer ticker.Stop()
+	page := newWebPage(newRef(p, resp.Ref.ID))
+	p.trackPage(page)
+	return page, nil
+}
+
+// WebPageOptions represents options for Process.CreateWebPageWithOptions().
+type WebPageOptions struct {
+	// If true, the page uses its own cookie jar instead of the cookie jar
+	// shared by all pages in the process. Cookies set by the page are not
+	// visible to other pages and are cleared by WebPage.Reset().
+	IsolateCookies bool
+}
+
+// CreateWebPageWithOptions returns a new instance of a "webpage" using opt.
+func (p *Process) CreateWebPageWithOptions(opt WebPageOptions) (*WebPage, error) {
+	var resp struct {
+		Ref refJSON `json:"ref"`
+	}
+	if err := p.doJSON("/webpage/Create", map[string]interface{}{"isolateCookies": opt.IsolateCookies}, &resp); err != nil {
+		return nil, err
+	}
+
+	page := newWebPage(newRef(p, resp.Ref.ID))
+	p.trackPage(page)
+	return page, nil
+}
+
+// Refs returns a list of all objects currently referenced by the process.
+func (p *Process) Refs() ([]*Ref, error) {
+	var resp struct {
+		Refs []refJSON `json:"refs"`
+	}
+	if err := p.doJSON("/process/Refs", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	a := make([]*Ref, len(resp.Refs))
+	for i, ref := range resp.Refs {
+		a[i] = newRef(p, ref.ID)
+		a[i].typ = ref.Type
+	}
+	return a, nil
+}
 
+// trackPage records page as open until it is closed. A finalizer reports the
+// page if it is garbage collected without being closed.
+func (p *Process) trackPage(page *WebPage) {
+	id, location := page.ref.id, callerLocation()
+
+	p.mu.Lock()
+	if p.pages == nil {
+		p.pages = make(map[string]string)
+	}
+	p.pages[id] = location
+	p.mu.Unlock()
+
+	runtime.SetFinalizer(page, func(*WebPage) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.pages[id]; ok && p.Stderr != nil {
+			fmt.Fprintf(p.Stderr, "phantomjs: web page garbage collected without being closed: ref=%s created at %s\n", id, location)
+		}
+	})
+}
+
+// untrackPage removes a page from the list of open pages.
+func (p *Process) untrackPage(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pages, id)
+}
+
+// reportLeaks writes a list of unclosed web pages to Stderr, if any.
+func (p *Process) reportLeaks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pages) == 0 || p.Stderr == nil {
+		return
+	}
+
+	ids := make([]string, 0, len(p.pages))
+	for id := range p.pages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintf(p.Stderr, "phantomjs: %d web page(s) were never closed:\n", len(ids))
+	for _, id := range ids {
+		fmt.Fprintf(p.Stderr, "\tref=%s created at %s\n", id, p.pages[id])
+	}
+	p.pages = nil
+}
+
+// callerLocation returns the file & line of the first caller outside this package.
+func callerLocation() string {
+	pc := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(2, pc)])
 	for {
-		select {
-		case <-timer.C:
-			return errors.New("timeout")
-		case <-ticker.C:
-			if err := p.ping(); err == nil {
-				return nil
-			}
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/benbjohnson/phantomjs.") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		} else if !more {
+			return "unknown"
 		}
 	}
 }
 
-// ping checks the process to see if it is up.
-func (p *Process) ping() error {
-	// Send request.
-	resp, err := http.Get(p.URL() + "/ping")
+// RenderPDF renders an HTML document to a PDF using size and returns the
+// encoded output. Relative URLs in the document are resolved against baseURL.
+//
+// A temporary web page is created for the render and is closed before
+// returning. The page waits for its images, fonts and other resources to load
+// before rendering or until ctx is done.
+func (p *Process) RenderPDF(ctx context.Context, html string, size PaperSize, baseURL string) (_ []byte, err error) {
+	page, err := p.CreateWebPage()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp.Body.Close()
+	defer func() {
+		if e := page.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
 
-	// Verify successful status code.
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	if err := page.SetPaperSize(size); err != nil {
+		return nil, err
+	} else if err := page.SetContentAndURL(html, baseURL); err != nil {
+		return nil, err
+	} else if err := page.WaitForLoad(ctx); err != nil {
+		return nil, err
 	}
-	return nil
+	return page.RenderBytes(RenderOptions{Format: RenderFormatPDF})
 }
 
-// CreateWebPage returns a new instance of a "webpage".
-func (p *Process) CreateWebPage() (*WebPage, error) {
-	var resp struct {
-		Ref refJSON `json:"ref"`
-	}
-	if err := p.doJSON("POST", "/webpage/Create", nil, &resp); err != nil {
+// RenderPDFTemplate executes tmpl with data and renders the result to a PDF.
+// See RenderPDF() for details.
+func (p *Process) RenderPDFTemplate(ctx context.Context, tmpl *template.Template, data interface{}, size PaperSize, baseURL string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
 		return nil, err
 	}
-	return &WebPage{ref: newRef(p, resp.Ref.ID)}, nil
+	return p.RenderPDF(ctx, buf.String(), size, baseURL)
 }
 
-// doJSON sends an HTTP request to url and encodes and decodes the req/resp as JSON.
-func (p *Process) doJSON(method, path string, req, resp interface{}) error {
+// doJSON encodes req as JSON, sends it to path using the process' transport
+// and decodes the response into resp.
+//
+// Errors returned by the shim are returned as a *RemoteError.
+func (p *Process) doJSON(path string, req, resp interface{}) error {
+	// Read the transport under lock since Close() may run concurrently.
+	p.mu.Lock()
+	opened, transport := p.opened, p.Transport
+	p.mu.Unlock()
+	if !opened || transport == nil {
+		return ErrProcessNotOpen
+	}
+
 	// Encode request.
-	var r io.Reader
+	var buf []byte
 	if req != nil {
-		buf, err := json.Marshal(req)
+		b, err := json.Marshal(req)
 		if err != nil {
 			return err
 		}
-		r = bytes.NewReader(buf)
-	}
-
-	// Create request.
-	httpRequest, err := http.NewRequest(method, p.URL()+path, r)
-	if err != nil {
-		return err
+		buf = b
 	}
 
 	// Send request.
-	httpResponse, err := http.DefaultClient.Do(httpRequest)
+	body, err := transport.Do(path, buf)
 	if err != nil {
 		return err
 	}
-	defer httpResponse.Body.Close()
-
-	// Read response body.
-	body, err := ioutil.ReadAll(httpResponse.Body)
-	if err != nil {
-		return err
-	}
-
-	// Check response code.
-	if httpResponse.StatusCode == http.StatusNotFound {
-		return fmt.Errorf("not found: %s", path)
-	}
 
 	// If an error was returned then return it.
 	var errResp errorResponse
 	if err := json.Unmarshal(body, &errResp); err != nil {
-		return errors.New("phantomjs.Process: " + string(body))
+		return &RemoteError{Endpoint: path, Code: ErrorCodeInvalidResponse, Message: string(body)}
 	} else if errResp.Error != "" {
-		return errors.New(errResp.Error)
+		return &RemoteError{Endpoint: path, Code: errResp.Code, Message: errResp.Error}
 	}
 
 	// Decode response if reference passed in.
 	if resp != nil {
 		if err := json.Unmarshal(body, resp); err != nil {
-			return fmt.Errorf("unmarshal error: err=%s, body=%s", err, body)
+			return fmt.Errorf("unmarshal error: err=%w, body=%s", err, body)
 		}
 	}
 
@@ -233,6 +475,41 @@ func (p *Process) doJSON(method, path string, req, resp interface{}) error {
 
 type errorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// Error codes returned by the shim.
+const (
+	ErrorCodeException       = "exception"
+	ErrorCodeRefNotFound     = "ref_not_found"
+	ErrorCodeNotFound        = "not_found"
+	ErrorCodeUnauthorized    = "unauthorized"
+	ErrorCodeBadRequest      = "bad_request"
+	ErrorCodeInvalidResponse = "invalid_response"
+	ErrorCodeOpenFailed      = "open_failed"
+)
+
+// RemoteError represents an error returned by the shim running inside
+// PhantomJS, such as a JavaScript exception or an unknown reference.
+type RemoteError struct {
+	Endpoint string // API path, e.g. "/webpage/Open"
+	Code     string // machine readable code, e.g. ErrorCodeRefNotFound
+	Message  string // human readable message
+}
+
+// Error returns the error message.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("phantomjs: %s: %s", e.Endpoint, e.Message)
+}
+
+// Is returns true if target is the sentinel error for the error's code.
+func (e *RemoteError) Is(target error) bool {
+	switch e.Code {
+	case ErrorCodeRefNotFound:
+		return target == ErrRefNotFound
+	default:
+		return false
+	}
 }
 
 // DefaultProcess is a global, shared process.
@@ -244,9 +521,126 @@ func CreateWebPage() (*WebPage, error) {
 	return DefaultProcess.CreateWebPage()
 }
 
+// RenderPDF renders an HTML document to a PDF using the default process.
+func RenderPDF(ctx context.Context, html string, size PaperSize, baseURL string) ([]byte, error) {
+	return DefaultProcess.RenderPDF(ctx, html, size, baseURL)
+}
+
+// RenderPDFTemplate executes tmpl with data and renders the result to a PDF
+// using the default process.
+func RenderPDFTemplate(ctx context.Context, tmpl *template.Template, data interface{}, size PaperSize, baseURL string) ([]byte, error) {
+	return DefaultProcess.RenderPDFTemplate(ctx, tmpl, data, size, baseURL)
+}
+
 // WebPage represents an object returned from "webpage.create()".
+//
+// A WebPage is safe for concurrent use. Each method call is serialized with
+// other calls on the same page. However, some state, such as the current
+// frame, is shared by all users of the page so a sequence of calls that
+// depends on that state should be wrapped in Do().
 type WebPage struct {
 	ref *Ref
+
+	mu     *sync.Mutex // serializes calls; shared with session views
+	locked bool        // true if mu is held by an enclosing Do()
+	closed *bool       // true once closed or released; guarded by mu
+}
+
+// Ref returns the process' reference to the page.
+func (p *WebPage) Ref() *Ref {
+	return p.ref
+}
+
+// newWebPage returns a new instance of WebPage for ref.
+func newWebPage(ref *Ref) *WebPage {
+	return &WebPage{ref: ref, mu: &sync.Mutex{}, closed: new(bool)}
+}
+
+// Do executes fn while holding exclusive access to the page. Calls made by
+// other goroutines wait until fn returns. Within fn, only the page passed as
+// an argument should be used; calling methods on the original page will
+// deadlock.
+//
+// Calling Do() on the page passed to fn executes the nested function
+// immediately within the same session.
+func (p *WebPage) Do(fn func(page *WebPage) error) error {
+	if p.locked {
+		return fn(p)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fn(&WebPage{ref: p.ref, mu: p.mu, locked: true, closed: p.closed})
+}
+
+// Closed returns true if the page has been closed or released, or if the
+// process has reported that the page no longer exists.
+func (p *WebPage) Closed() bool {
+	if !p.locked {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+	return *p.closed
+}
+
+// doJSON sends a request to the page's process while holding the page lock.
+// Returns ErrPageClosed without contacting the process if the page is closed.
+// A missing reference is returned as a *PageClosedError.
+func (p *WebPage) doJSON(path string, req, resp interface{}) error {
+	if !p.locked {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+	return p.send(path, req, resp)
+}
+
+// close sends a request to path that removes the page's reference and marks
+// the page as closed on success.
+func (p *WebPage) close(path string) error {
+	if !p.locked {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	}
+	if err := p.send(path, map[string]interface{}{"ref": p.ref.id}, nil); err != nil {
+		return err
+	}
+	*p.closed = true
+	return nil
+}
+
+// send sends a request to the page's process. The page lock must be held.
+func (p *WebPage) send(path string, req, resp interface{}) error {
+	if *p.closed {
+		return ErrPageClosed
+	}
+
+	err := p.ref.process.doJSON(path, req, resp)
+	if errors.Is(err, ErrRefNotFound) {
+		*p.closed = true
+		return &PageClosedError{Err: err}
+	}
+	return err
+}
+
+// PageClosedError is returned when the process no longer has a reference to
+// a web page. It matches both ErrPageClosed and ErrRefNotFound.
+type PageClosedError struct {
+	Err error // underlying error from the process
+}
+
+// Error returns the error message.
+func (e *PageClosedError) Error() string {
+	return ErrPageClosed.Error() + ": " + e.Err.Error()
+}
+
+// Is returns true if target is ErrPageClosed.
+func (e *PageClosedError) Is(target error) bool {
+	return target == ErrPageClosed
+}
+
+// Unwrap returns the underlying error.
+func (e *PageClosedError) Unwrap() error {
+	return e.Err
 }
 
 // Open opens a URL.
@@ -258,7 +652,7 @@ func (p *WebPage) Open(url string) error {
 	var resp struct {
 		Status string `json:"status"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Open", req, &resp); err != nil {
+	if err := p.doJSON("/webpage/Open", req, &resp); err != nil {
 		return err
 	}
 
@@ -273,7 +667,7 @@ func (p *WebPage) CanGoBack() (bool, error) {
 	var resp struct {
 		Value bool `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/CanGoBack", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/CanGoBack", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return false, err
 	}
 	return resp.Value, nil
@@ -284,7 +678,7 @@ func (p *WebPage) CanGoForward() (bool, error) {
 	var resp struct {
 		Value bool `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/CanGoForward", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/CanGoForward", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return false, err
 	}
 	return resp.Value, nil
@@ -296,7 +690,7 @@ func (p *WebPage) ClipRect() (Rect, error) {
 	var resp struct {
 		Value rectJSON `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/ClipRect", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/ClipRect", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return Rect{}, err
 	}
 	return Rect{
@@ -319,7 +713,7 @@ func (p *WebPage) SetClipRect(rect Rect) error {
 			Height: rect.Height,
 		},
 	}
-	return p.ref.process.doJSON("POST", "/webpage/SetClipRect", req, nil)
+	return p.doJSON("/webpage/SetClipRect", req, nil)
 }
 
 // Content returns content of the webpage enclosed in an HTML/XML element.
@@ -327,7 +721,7 @@ func (p *WebPage) Content() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Content", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Content", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -335,7 +729,7 @@ func (p *WebPage) Content() (string, error) {
 
 // SetContent sets the content of the webpage.
 func (p *WebPage) SetContent(content string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetContent", map[string]interface{}{"ref": p.ref.id, "content": content}, nil)
+	return p.doJSON("/webpage/SetContent", map[string]interface{}{"ref": p.ref.id, "content": content}, nil)
 }
 
 // Cookies returns a list of cookies visible to the current URL.
@@ -343,7 +737,7 @@ func (p *WebPage) Cookies() ([]*http.Cookie, error) {
 	var resp struct {
 		Value []cookieJSON `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Cookies", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Cookies", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return nil, err
 	}
 
@@ -361,7 +755,7 @@ func (p *WebPage) SetCookies(cookies []*http.Cookie) error {
 		a[i] = encodeCookieJSON(cookies[i])
 	}
 	req := map[string]interface{}{"ref": p.ref.id, "cookies": a}
-	return p.ref.process.doJSON("POST", "/webpage/SetCookies", req, nil)
+	return p.doJSON("/webpage/SetCookies", req, nil)
 }
 
 // CustomHeaders returns a list of additional headers sent with the web page.
@@ -369,7 +763,7 @@ func (p *WebPage) CustomHeaders() (http.Header, error) {
 	var resp struct {
 		Value map[string]string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/CustomHeaders", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/CustomHeaders", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return nil, err
 	}
 
@@ -391,7 +785,7 @@ func (p *WebPage) SetCustomHeaders(header http.Header) error {
 		m[key] = header.Get(key)
 	}
 	req := map[string]interface{}{"ref": p.ref.id, "headers": m}
-	return p.ref.process.doJSON("POST", "/webpage/SetCustomHeaders", req, nil)
+	return p.doJSON("/webpage/SetCustomHeaders", req, nil)
 }
 
 // FocusedFrameName returns the name of the currently focused frame.
@@ -399,7 +793,7 @@ func (p *WebPage) FocusedFrameName() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FocusedFrameName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FocusedFrameName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -410,7 +804,7 @@ func (p *WebPage) FrameContent() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameContent", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameContent", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -418,7 +812,7 @@ func (p *WebPage) FrameContent() (string, error) {
 
 // SetFrameContent sets the content of the current frame.
 func (p *WebPage) SetFrameContent(content string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetFrameContent", map[string]interface{}{"ref": p.ref.id, "content": content}, nil)
+	return p.doJSON("/webpage/SetFrameContent", map[string]interface{}{"ref": p.ref.id, "content": content}, nil)
 }
 
 // FrameName returns the name of the current frame.
@@ -426,7 +820,7 @@ func (p *WebPage) FrameName() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -437,7 +831,7 @@ func (p *WebPage) FramePlainText() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FramePlainText", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FramePlainText", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -448,7 +842,7 @@ func (p *WebPage) FrameTitle() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameTitle", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameTitle", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -459,7 +853,7 @@ func (p *WebPage) FrameURL() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameURL", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameURL", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -470,7 +864,7 @@ func (p *WebPage) FrameCount() (int, error) {
 	var resp struct {
 		Value int `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameCount", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameCount", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return 0, err
 	}
 	return resp.Value, nil
@@ -481,7 +875,7 @@ func (p *WebPage) FrameNames() ([]string, error) {
 	var resp struct {
 		Value []string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/FrameNames", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/FrameNames", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return nil, err
 	}
 	return resp.Value, nil
@@ -493,7 +887,7 @@ func (p *WebPage) LibraryPath() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/LibraryPath", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/LibraryPath", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -501,7 +895,7 @@ func (p *WebPage) LibraryPath() (string, error) {
 
 // SetLibraryPath sets the library path used by InjectJS().
 func (p *WebPage) SetLibraryPath(path string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetLibraryPath", map[string]interface{}{"ref": p.ref.id, "path": path}, nil)
+	return p.doJSON("/webpage/SetLibraryPath", map[string]interface{}{"ref": p.ref.id, "path": path}, nil)
 }
 
 // NavigationLocked returns true if the navigation away from the page is disabled.
@@ -509,7 +903,7 @@ func (p *WebPage) NavigationLocked() (bool, error) {
 	var resp struct {
 		Value bool `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/NavigationLocked", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/NavigationLocked", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return false, err
 	}
 	return resp.Value, nil
@@ -517,7 +911,7 @@ func (p *WebPage) NavigationLocked() (bool, error) {
 
 // SetNavigationLocked sets whether navigation away from the page should be disabled.
 func (p *WebPage) SetNavigationLocked(value bool) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetNavigationLocked", map[string]interface{}{"ref": p.ref.id, "value": value}, nil)
+	return p.doJSON("/webpage/SetNavigationLocked", map[string]interface{}{"ref": p.ref.id, "value": value}, nil)
 }
 
 // OfflineStoragePath returns the path used by offline storage.
@@ -525,7 +919,7 @@ func (p *WebPage) OfflineStoragePath() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/OfflineStoragePath", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/OfflineStoragePath", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -536,7 +930,7 @@ func (p *WebPage) OfflineStorageQuota() (int, error) {
 	var resp struct {
 		Value int `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/OfflineStorageQuota", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/OfflineStorageQuota", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return 0, err
 	}
 	return resp.Value, nil
@@ -547,7 +941,7 @@ func (p *WebPage) OwnsPages() (bool, error) {
 	var resp struct {
 		Value bool `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/OwnsPages", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/OwnsPages", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return false, err
 	}
 	return resp.Value, nil
@@ -555,7 +949,7 @@ func (p *WebPage) OwnsPages() (bool, error) {
 
 // SetOwnsPages sets whether this page owns pages opened in other windows.
 func (p *WebPage) SetOwnsPages(v bool) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetOwnsPages", map[string]interface{}{"ref": p.ref.id, "value": v}, nil)
+	return p.doJSON("/webpage/SetOwnsPages", map[string]interface{}{"ref": p.ref.id, "value": v}, nil)
 }
 
 // PageWindowNames returns an list of owned window names.
@@ -563,7 +957,7 @@ func (p *WebPage) PageWindowNames() ([]string, error) {
 	var resp struct {
 		Value []string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/PageWindowNames", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/PageWindowNames", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return nil, err
 	}
 	return resp.Value, nil
@@ -574,14 +968,14 @@ func (p *WebPage) Pages() ([]*WebPage, error) {
 	var resp struct {
 		Refs []refJSON `json:"refs"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Pages", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Pages", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return nil, err
 	}
 
 	// Convert reference IDs to web pages.
 	a := make([]*WebPage, len(resp.Refs))
 	for i, ref := range resp.Refs {
-		a[i] = &WebPage{ref: newRef(p.ref.process, ref.ID)}
+		a[i] = newWebPage(newRef(p.ref.process, ref.ID))
 	}
 	return a, nil
 }
@@ -591,7 +985,7 @@ func (p *WebPage) PaperSize() (PaperSize, error) {
 	var resp struct {
 		Value paperSizeJSON `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/PaperSize", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/PaperSize", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return PaperSize{}, err
 	}
 	return decodePaperSizeJSON(resp.Value), nil
@@ -600,7 +994,7 @@ func (p *WebPage) PaperSize() (PaperSize, error) {
 // SetPaperSize sets the size of the web page when rendered as a PDF.
 func (p *WebPage) SetPaperSize(size PaperSize) error {
 	req := map[string]interface{}{"ref": p.ref.id, "size": encodePaperSizeJSON(size)}
-	return p.ref.process.doJSON("POST", "/webpage/SetPaperSize", req, nil)
+	return p.doJSON("/webpage/SetPaperSize", req, nil)
 }
 
 // PlainText returns the plain text representation of the page.
@@ -608,19 +1002,31 @@ func (p *WebPage) PlainText() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/PlainText", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/PlainText", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
 }
 
+// PendingResourceCount returns the number of resources that have been
+// requested by the page but have not yet finished loading.
+func (p *WebPage) PendingResourceCount() (int, error) {
+	var resp struct {
+		Value int `json:"value"`
+	}
+	if err := p.doJSON("/webpage/PendingResourceCount", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Value, nil
+}
+
 // ScrollPosition returns the current scroll position of the page.
 func (p *WebPage) ScrollPosition() (Position, error) {
 	var resp struct {
 		Top  int `json:"top"`
 		Left int `json:"left"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/ScrollPosition", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/ScrollPosition", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return Position{}, err
 	}
 	return Position{Top: resp.Top, Left: resp.Left}, nil
@@ -628,7 +1034,7 @@ func (p *WebPage) ScrollPosition() (Position, error) {
 
 // SetScrollPosition sets the current scroll position of the page.
 func (p *WebPage) SetScrollPosition(pos Position) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetScrollPosition", map[string]interface{}{"ref": p.ref.id, "top": pos.Top, "left": pos.Left}, nil)
+	return p.doJSON("/webpage/SetScrollPosition", map[string]interface{}{"ref": p.ref.id, "top": pos.Top, "left": pos.Left}, nil)
 }
 
 // Settings returns the settings used on the web page.
@@ -636,20 +1042,10 @@ func (p *WebPage) Settings() (WebPageSettings, error) {
 	var resp struct {
 		Settings webPageSettingsJSON `json:"settings"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Settings", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Settings", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return WebPageSettings{}, err
 	}
-	return WebPageSettings{
-		JavascriptEnabled:             resp.Settings.JavascriptEnabled,
-		LoadImages:                    resp.Settings.LoadImages,
-		LocalToRemoteURLAccessEnabled: resp.Settings.LocalToRemoteURLAccessEnabled,
-		UserAgent:                     resp.Settings.UserAgent,
-		Username:                      resp.Settings.Username,
-		Password:                      resp.Settings.Password,
-		XSSAuditingEnabled:            resp.Settings.XSSAuditingEnabled,
-		WebSecurityEnabled:            resp.Settings.WebSecurityEnabled,
-		ResourceTimeout:               time.Duration(resp.Settings.ResourceTimeout) * time.Millisecond,
-	}, nil
+	return decodeWebPageSettingsJSON(resp.Settings), nil
 }
 
 // SetSettings sets various settings on the web page.
@@ -657,21 +1053,31 @@ func (p *WebPage) Settings() (WebPageSettings, error) {
 // The settings apply only during the initial call to the page.open function.
 // Subsequent modification of the settings object will not have any impact.
 func (p *WebPage) SetSettings(settings WebPageSettings) error {
-	req := map[string]interface{}{
-		"ref": p.ref.id,
-		"settings": webPageSettingsJSON{
-			JavascriptEnabled:             settings.JavascriptEnabled,
-			LoadImages:                    settings.LoadImages,
-			LocalToRemoteURLAccessEnabled: settings.LocalToRemoteURLAccessEnabled,
-			UserAgent:                     settings.UserAgent,
-			Username:                      settings.Username,
-			Password:                      settings.Password,
-			XSSAuditingEnabled:            settings.XSSAuditingEnabled,
-			WebSecurityEnabled:            settings.WebSecurityEnabled,
-			ResourceTimeout:               int(settings.ResourceTimeout / time.Millisecond),
-		},
-	}
-	return p.ref.process.doJSON("POST", "/webpage/SetSettings", req, nil)
+	req := map[string]interface{}{"ref": p.ref.id, "settings": encodeWebPageSettingsJSON(settings)}
+	return p.doJSON("/webpage/SetSettings", req, nil)
+}
+
+// UpdateSettings reads the current settings, passes them to fn for
+// modification and then sends only the fields that fn changed. Settings
+// that were not changed by fn are left as-is on the page.
+func (p *WebPage) UpdateSettings(fn func(settings *WebPageSettings)) error {
+	return p.Do(func(page *WebPage) error {
+		prev, err := page.Settings()
+		if err != nil {
+			return err
+		}
+
+		settings := prev
+		fn(&settings)
+
+		patch, err := diffWebPageSettings(prev, settings)
+		if err != nil {
+			return err
+		} else if len(patch) == 0 {
+			return nil
+		}
+		return page.doJSON("/webpage/UpdateSettings", map[string]interface{}{"ref": page.ref.id, "settings": patch}, nil)
+	})
 }
 
 // Title returns the title of the web page.
@@ -679,7 +1085,7 @@ func (p *WebPage) Title() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Title", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Title", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -690,7 +1096,7 @@ func (p *WebPage) URL() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/URL", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/URL", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -702,7 +1108,7 @@ func (p *WebPage) ViewportSize() (width, height int, err error) {
 		Width  int `json:"width"`
 		Height int `json:"height"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/ViewportSize", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/ViewportSize", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return 0, 0, err
 	}
 	return resp.Width, resp.Height, nil
@@ -710,7 +1116,7 @@ func (p *WebPage) ViewportSize() (width, height int, err error) {
 
 // SetViewportSize sets the size of the viewport.
 func (p *WebPage) SetViewportSize(width, height int) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetViewportSize", map[string]interface{}{"ref": p.ref.id, "width": width, "height": height}, nil)
+	return p.doJSON("/webpage/SetViewportSize", map[string]interface{}{"ref": p.ref.id, "width": width, "height": height}, nil)
 }
 
 // WindowName returns the window name of the web page.
@@ -718,7 +1124,7 @@ func (p *WebPage) WindowName() (string, error) {
 	var resp struct {
 		Value string `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/WindowName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/WindowName", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return "", err
 	}
 	return resp.Value, nil
@@ -729,7 +1135,7 @@ func (p *WebPage) ZoomFactor() (float64, error) {
 	var resp struct {
 		Value float64 `json:"value"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/ZoomFactor", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
+	if err := p.doJSON("/webpage/ZoomFactor", map[string]interface{}{"ref": p.ref.id}, &resp); err != nil {
 		return 0, err
 	}
 	return resp.Value, nil
@@ -737,7 +1143,7 @@ func (p *WebPage) ZoomFactor() (float64, error) {
 
 // SetZoomFactor sets the zoom factor when rendering the page.
 func (p *WebPage) SetZoomFactor(factor float64) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetZoomFactor", map[string]interface{}{"ref": p.ref.id, "value": factor}, nil)
+	return p.doJSON("/webpage/SetZoomFactor", map[string]interface{}{"ref": p.ref.id, "value": factor}, nil)
 }
 
 // AddCookie adds a cookie to the page.
@@ -747,7 +1153,7 @@ func (p *WebPage) AddCookie(cookie *http.Cookie) (bool, error) {
 		ReturnValue bool `json:"returnValue"`
 	}
 	req := map[string]interface{}{"ref": p.ref.id, "cookie": encodeCookieJSON(cookie)}
-	if err := p.ref.process.doJSON("POST", "/webpage/AddCookie", req, &resp); err != nil {
+	if err := p.doJSON("/webpage/AddCookie", req, &resp); err != nil {
 		return false, err
 	}
 	return resp.ReturnValue, nil
@@ -755,12 +1161,31 @@ func (p *WebPage) AddCookie(cookie *http.Cookie) (bool, error) {
 
 // ClearCookies deletes all cookies visible to the current URL.
 func (p *WebPage) ClearCookies() error {
-	return p.ref.process.doJSON("POST", "/webpage/ClearCookies", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/ClearCookies", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
-// Close releases the web page and its resources.
+// Close releases the web page and its resources. Pages owned by this page
+// are also closed. Returns ErrPageClosed if the page is already closed.
 func (p *WebPage) Close() error {
-	return p.ref.process.doJSON("POST", "/webpage/Close", map[string]interface{}{"ref": p.ref.id}, nil)
+	err := p.close("/webpage/Close")
+	if err == nil || errors.Is(err, ErrPageClosed) {
+		p.ref.process.untrackPage(p.ref.id)
+	}
+	return err
+}
+
+// Release removes the process' reference to the page without closing it.
+//
+// This should be used for pages returned by Pages() or Page() once they are
+// no longer needed since those pages are closed by their owner. The page
+// cannot be used once it has been released. Releasing a page that the process
+// no longer references returns an error matching ErrRefNotFound.
+func (p *WebPage) Release() error {
+	err := p.close("/ref/Release")
+	if err == nil || errors.Is(err, ErrPageClosed) {
+		p.ref.process.untrackPage(p.ref.id)
+	}
+	return err
 }
 
 // DeleteCookie removes a cookie with a matching name.
@@ -770,7 +1195,7 @@ func (p *WebPage) DeleteCookie(name string) (bool, error) {
 		ReturnValue bool `json:"returnValue"`
 	}
 	req := map[string]interface{}{"ref": p.ref.id, "name": name}
-	if err := p.ref.process.doJSON("POST", "/webpage/DeleteCookie", req, &resp); err != nil {
+	if err := p.doJSON("/webpage/DeleteCookie", req, &resp); err != nil {
 		return false, err
 	}
 	return resp.ReturnValue, nil
@@ -779,7 +1204,7 @@ func (p *WebPage) DeleteCookie(name string) (bool, error) {
 // EvaluateAsync executes a JavaScript function and returns immediately.
 // Execution is delayed by delay. No value is returned.
 func (p *WebPage) EvaluateAsync(script string, delay time.Duration) error {
-	return p.ref.process.doJSON("POST", "/webpage/EvaluateAsync", map[string]interface{}{"ref": p.ref.id, "script": script, "delay": int(delay / time.Millisecond)}, nil)
+	return p.doJSON("/webpage/EvaluateAsync", map[string]interface{}{"ref": p.ref.id, "script": script, "delay": int(delay / time.Millisecond)}, nil)
 }
 
 // EvaluateJavaScript executes a JavaScript function.
@@ -788,7 +1213,7 @@ func (p *WebPage) EvaluateJavaScript(script string) (interface{}, error) {
 	var resp struct {
 		ReturnValue interface{} `json:"returnValue"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/EvaluateJavaScript", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
+	if err := p.doJSON("/webpage/EvaluateJavaScript", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
 		return nil, err
 	}
 	return resp.ReturnValue, nil
@@ -800,7 +1225,7 @@ func (p *WebPage) Evaluate(script string) (interface{}, error) {
 	var resp struct {
 		ReturnValue interface{} `json:"returnValue"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Evaluate", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Evaluate", map[string]interface{}{"ref": p.ref.id, "script": script}, &resp); err != nil {
 		return nil, err
 	}
 	return resp.ReturnValue, nil
@@ -812,35 +1237,48 @@ func (p *WebPage) Page(name string) (*WebPage, error) {
 	var resp struct {
 		Ref refJSON `json:"ref"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/Page", map[string]interface{}{"ref": p.ref.id, "name": name}, &resp); err != nil {
+	if err := p.doJSON("/webpage/Page", map[string]interface{}{"ref": p.ref.id, "name": name}, &resp); err != nil {
 		return nil, err
 	}
 	if resp.Ref.ID == "" {
 		return nil, nil
 	}
-	return &WebPage{ref: newRef(p.ref.process, resp.Ref.ID)}, nil
+	return newWebPage(newRef(p.ref.process, resp.Ref.ID)), nil
 }
 
 // GoBack navigates back to the previous page.
 func (p *WebPage) GoBack() error {
-	return p.ref.process.doJSON("POST", "/webpage/GoBack", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/GoBack", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // GoForward navigates to the next page.
 func (p *WebPage) GoForward() error {
-	return p.ref.process.doJSON("POST", "/webpage/GoForward", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/GoForward", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // Go navigates to the page in history by relative offset.
 // A positive index moves forward, a negative index moves backwards.
 func (p *WebPage) Go(index int) error {
-	return p.ref.process.doJSON("POST", "/webpage/Go", map[string]interface{}{"ref": p.ref.id, "index": index}, nil)
+	return p.doJSON("/webpage/Go", map[string]interface{}{"ref": p.ref.id, "index": index}, nil)
 }
 
 // IncludeJS includes an external script from url.
 // Returns after the script has been loaded.
 func (p *WebPage) IncludeJS(url string) error {
-	return p.ref.process.doJSON("POST", "/webpage/IncludeJS", map[string]interface{}{"ref": p.ref.id, "url": url}, nil)
+	return p.doJSON("/webpage/IncludeJS", map[string]interface{}{"ref": p.ref.id, "url": url}, nil)
+}
+
+// AddInitScript adds a script that is run each time the page's window object
+// is created, before any of the page's own scripts run. Scripts persist across
+// navigations and reloads and run in the order they were added. Scripts are
+// evaluated in the global scope of the main frame.
+//
+// Scripts are also run in child frames, such as iframes, once the page has
+// finished loading. Scripts in a child frame may run before its init scripts.
+//
+// Scripts are removed by Reset().
+func (p *WebPage) AddInitScript(source string) error {
+	return p.doJSON("/webpage/AddInitScript", map[string]interface{}{"ref": p.ref.id, "source": source}, nil)
 }
 
 // InjectJS injects an external script from the local filesystem.
@@ -851,7 +1289,7 @@ func (p *WebPage) InjectJS(filename string) error {
 	var resp struct {
 		ReturnValue bool `json:"returnValue"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/InjectJS", map[string]interface{}{"ref": p.ref.id, "filename": filename}, &resp); err != nil {
+	if err := p.doJSON("/webpage/InjectJS", map[string]interface{}{"ref": p.ref.id, "filename": filename}, &resp); err != nil {
 		return err
 	}
 	if !resp.ReturnValue {
@@ -860,17 +1298,71 @@ func (p *WebPage) InjectJS(filename string) error {
 	return nil
 }
 
+// Reset restores the web page to the state it had when it was created so
+// that it can be reused by unrelated work. Custom headers, content, settings,
+// viewport, clipping, zoom, paper size, scroll position and event handlers
+// are reset, owned pages are closed and the main frame is selected.
+//
+// Cookies are only cleared if the page was created with its own cookie jar
+// using WebPageOptions.IsolateCookies. Otherwise the cookie jar is shared with
+// other pages in the process and is left unchanged. Navigation history is
+// not cleared.
+func (p *WebPage) Reset() error {
+	return p.doJSON("/webpage/Reset", map[string]interface{}{"ref": p.ref.id}, nil)
+}
+
 // Reload reloads the current web page.
 func (p *WebPage) Reload() error {
-	return p.ref.process.doJSON("POST", "/webpage/Reload", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/Reload", map[string]interface{}{"ref": p.ref.id}, nil)
+}
+
+// SetDeterministic puts the page in deterministic mode so repeated renders of
+// the same content produce the same output. Math.random is seeded, CSS
+// animations & transitions are disabled and the text caret is hidden on each
+// navigation. Before rendering, the page waits until the document, its images
+// and fonts have loaded and no resources are pending, or until opt.Timeout.
+//
+// The caret is hidden with caret-color where supported and, otherwise, by
+// blurring the focused element and clearing the selection before rendering,
+// so a caret placed by the page's own timers may still appear. If the page
+// lacks document.fonts then @font-face fonts in same-origin stylesheets are
+// considered loaded once text measures differently with them. Fonts that
+// never load, or whose metrics match the fallback fonts, delay rendering
+// until the timeout.
+//
+// Deterministic mode is disabled by Reset().
+func (p *WebPage) SetDeterministic(opt DeterministicOptions) error {
+	timeout := opt.Timeout
+	if timeout == 0 {
+		timeout = DefaultSettleTimeout
+	}
+	req := map[string]interface{}{"ref": p.ref.id, "seed": uint32(opt.Seed), "timeout": int(timeout / time.Millisecond)}
+	return p.doJSON("/webpage/SetDeterministic", req, nil)
+}
+
+// DeterministicOptions represents options for WebPage.SetDeterministic().
+type DeterministicOptions struct {
+	// Seed used by Math.random. Only the lower 32 bits are used.
+	Seed int64
+
+	// Maximum time to wait for the page to settle before rendering.
+	// Defaults to DefaultSettleTimeout.
+	Timeout time.Duration
 }
 
 // RenderBase64 renders the web page to a base64 encoded string.
-func (p *WebPage) RenderBase64(format string) (string, error) {
+// Only the PNG, JPEG, and GIF formats are supported.
+func (p *WebPage) RenderBase64(format RenderFormat) (string, error) {
+	if err := format.Validate(); err != nil {
+		return "", err
+	} else if !format.IsBase64Encodable() {
+		return "", fmt.Errorf("%w: %s", ErrRenderFormatNotSupported, format)
+	}
+
 	var resp struct {
 		ReturnValue string `json:"returnValue"`
 	}
-	if err := p.ref.process.doJSON("POST", "/webpage/RenderBase64", map[string]interface{}{"ref": p.ref.id, "format": format}, &resp); err != nil {
+	if err := p.doJSON("/webpage/RenderBase64", map[string]interface{}{"ref": p.ref.id, "format": format.normalize()}, &resp); err != nil {
 		return "", err
 	}
 	return resp.ReturnValue, nil
@@ -878,9 +1370,266 @@ func (p *WebPage) RenderBase64(format string) (string, error) {
 
 // Render renders the web page to a file with the given format and quality settings.
 // This supports the "PDF", "PNG", "JPEG", "BMP", "PPM", and "GIF" formats.
-func (p *WebPage) Render(filename, format string, quality int) error {
-	req := map[string]interface{}{"ref": p.ref.id, "filename": filename, "format": format, "quality": quality}
-	return p.ref.process.doJSON("POST", "/webpage/Render", req, nil)
+func (p *WebPage) Render(filename string, format RenderFormat, quality int) error {
+	return p.RenderWithOptions(filename, RenderOptions{Format: format, Quality: quality})
+}
+
+// RenderWithOptions renders the web page to a file using opt.
+// The options are validated before being sent to the process.
+func (p *WebPage) RenderWithOptions(filename string, opt RenderOptions) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+
+	// Scroll through the page so lazily loaded content is present and then
+	// clip to the full document. This is performed in a single session so
+	// other users of the page cannot scroll in between.
+	if opt.FullPage {
+		return p.Do(func(page *WebPage) error {
+			rect, err := page.scrollFullPage(opt)
+			if err != nil {
+				return err
+			}
+			opt.ClipRect, opt.FullPage = &rect, false
+			return page.RenderWithOptions(filename, opt)
+		})
+	}
+
+	req := map[string]interface{}{"ref": p.ref.id, "filename": filename, "options": encodeRenderOptionsJSON(opt)}
+	return p.doJSON("/webpage/Render", req, nil)
+}
+
+// scrollFullPage scrolls through the document one viewport at a time, waiting
+// for resources to settle after each step. The original scroll position is
+// restored afterward. Returns the document area to render, limited by the
+// maximum height in opt.
+//
+// The document height is reported in CSS pixels while the viewport, scroll
+// position and clip rectangle are in rendered pixels so the height is scaled
+// by the zoom factor used for rendering. If opt sets a zoom factor then it is
+// applied while scrolling so the document is laid out as it will be rendered.
+func (p *WebPage) scrollFullPage(opt RenderOptions) (_ Rect, err error) {
+	maxHeight := opt.MaxHeight
+	if maxHeight == 0 {
+		maxHeight = DefaultFullPageMaxHeight
+	}
+	settleTimeout := opt.SettleTimeout
+	if settleTimeout == 0 {
+		settleTimeout = DefaultSettleTimeout
+	}
+
+	width, viewportHeight, err := p.ViewportSize()
+	if err != nil {
+		return Rect{}, err
+	} else if viewportHeight <= 0 {
+		return Rect{}, errors.New("viewport size required for full page render")
+	}
+
+	zoom, err := p.ZoomFactor()
+	if err != nil {
+		return Rect{}, err
+	}
+	if opt.ZoomFactor != 0 && opt.ZoomFactor != zoom {
+		if err := p.SetZoomFactor(opt.ZoomFactor); err != nil {
+			return Rect{}, err
+		}
+		defer func(zoom float64) {
+			if e := p.SetZoomFactor(zoom); e != nil && err == nil {
+				err = e
+			}
+		}(zoom)
+		zoom = opt.ZoomFactor
+	}
+
+	prev, err := p.ScrollPosition()
+	if err != nil {
+		return Rect{}, err
+	}
+
+	// Scroll until we reach the bottom of the document, which may grow as
+	// content is loaded, or until we exceed the maximum height.
+	height, err := p.documentHeight(zoom)
+	if err != nil {
+		return Rect{}, err
+	}
+	for top := 0; top < height && top < maxHeight; top += viewportHeight {
+		if err := p.SetScrollPosition(Position{Top: top, Left: prev.Left}); err != nil {
+			return Rect{}, err
+		} else if err := p.waitForResources(settleTimeout); err != nil {
+			return Rect{}, err
+		}
+
+		if height, err = p.documentHeight(zoom); err != nil {
+			return Rect{}, err
+		}
+	}
+
+	if err := p.SetScrollPosition(prev); err != nil {
+		return Rect{}, err
+	}
+
+	if height > maxHeight {
+		height = maxHeight
+	}
+	return Rect{Width: width, Height: height}, nil
+}
+
+// documentHeight returns the full scrollable height of the document, in
+// rendered pixels at the given zoom factor.
+func (p *WebPage) documentHeight(zoom float64) (int, error) {
+	v, err := p.Evaluate(`function() {
+		return Math.max(document.body ? document.body.scrollHeight : 0, document.documentElement.scrollHeight);
+	}`)
+	if err != nil {
+		return 0, err
+	}
+	height, _ := v.(float64)
+	if zoom <= 0 {
+		zoom = 1
+	}
+	return int(math.Ceil(height * zoom)), nil
+}
+
+// WaitForLoad blocks until the document, its images and its web fonts have
+// finished loading and no resources are pending, or until ctx is done.
+func (p *WebPage) WaitForLoad(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if n, err := p.PendingResourceCount(); err != nil {
+			return err
+		} else if n == 0 {
+			if v, err := p.Evaluate(`function() {
+				if (document.readyState !== 'complete') return false;
+				for (var i = 0; i < document.images.length; i++) {
+					if (!document.images[i].complete) return false;
+				}
+				if (document.fonts && document.fonts.status !== 'loaded') return false;
+				return true;
+			}`); err != nil {
+				return err
+			} else if loaded, _ := v.(bool); loaded {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForResources polls the page until no resources are pending or until
+// timeout elapses. A timeout is not considered an error since some pages
+// continually poll the network.
+func (p *WebPage) waitForResources(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if n, err := p.PendingResourceCount(); err != nil {
+			return err
+		} else if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RenderBytes renders the web page using opt and returns the encoded output.
+//
+// The page is rendered to a temporary file within Process.Path() which is
+// removed once it has been read.
+func (p *WebPage) RenderBytes(opt RenderOptions) ([]byte, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p.renderFile(opt.Format, func(filename string) error {
+		return p.RenderWithOptions(filename, opt)
+	})
+}
+
+// renderFile executes fn with a temporary filename within Process.Path() and
+// returns the contents of the file once fn completes. The file is removed
+// before returning.
+func (p *WebPage) renderFile(format RenderFormat, fn func(filename string) error) ([]byte, error) {
+	f, err := ioutil.TempFile(p.ref.process.Path(), "render-*."+string(format.normalize()))
+	if err != nil {
+		return nil, err
+	}
+	filename := f.Name()
+	f.Close()
+	defer os.Remove(filename)
+
+	if err := fn(filename); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// ScreenshotElement renders the area of the first element matching selector
+// and returns the encoded output.
+func (p *WebPage) ScreenshotElement(selector string, format RenderFormat) ([]byte, error) {
+	return p.ScreenshotElementWithOptions(selector, ScreenshotElementOptions{Format: format})
+}
+
+// ScreenshotElementWithOptions renders the area of the first element matching
+// selector using opt and returns the encoded output.
+//
+// The element's bounds are computed, rendered and the previous clipping
+// rectangle restored in a single call to the process so other users of the
+// page are not affected. Returns ErrElementNotFound if no element matches.
+func (p *WebPage) ScreenshotElementWithOptions(selector string, opt ScreenshotElementOptions) ([]byte, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p.renderFile(opt.Format, func(filename string) error {
+		var resp struct {
+			Found bool `json:"found"`
+		}
+		req := map[string]interface{}{
+			"ref":      p.ref.id,
+			"selector": selector,
+			"filename": filename,
+			"padding":  opt.Padding,
+			"options":  encodeRenderOptionsJSON(RenderOptions{Format: opt.Format, Quality: opt.Quality}),
+		}
+		if err := p.doJSON("/webpage/ScreenshotElement", req, &resp); err != nil {
+			return err
+		} else if !resp.Found {
+			return fmt.Errorf("%w: %s", ErrElementNotFound, selector)
+		}
+		return nil
+	})
+}
+
+// RenderImage renders the web page using opt and decodes the result.
+// All raster formats can be decoded.
+func (p *WebPage) RenderImage(opt RenderOptions) (image.Image, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	} else if !opt.Format.IsDecodable() {
+		return nil, fmt.Errorf("%w: %s", ErrRenderFormatNotSupported, opt.Format)
+	}
+
+	buf, err := p.RenderBytes(opt)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(opt.Format, buf)
 }
 
 // SendMouseEvent sends a mouse event as if it came from the user.
@@ -890,7 +1639,7 @@ func (p *WebPage) Render(filename, format string, quality int) error {
 // or "click". The mouseX and mouseY specify the position of the mouse on the
 // screen. The button argument specifies the mouse button clicked (e.g. "left").
 func (p *WebPage) SendMouseEvent(eventType string, mouseX, mouseY int, button string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SendMouseEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "mouseX": mouseX, "mouseY": mouseY, "button": button}, nil)
+	return p.doJSON("/webpage/SendMouseEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "mouseX": mouseX, "mouseY": mouseY, "button": button}, nil)
 }
 
 // SendKeyboardEvent sends a keyboard event as if it came from the user.
@@ -903,47 +1652,47 @@ func (p *WebPage) SendMouseEvent(eventType string, mouseX, mouseY int, button st
 //
 // Keyboard modifiers can be joined together using the bitwise OR operator.
 func (p *WebPage) SendKeyboardEvent(eventType string, key string, modifier int) error {
-	return p.ref.process.doJSON("POST", "/webpage/SendKeyboardEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "key": key, "modifier": modifier}, nil)
+	return p.doJSON("/webpage/SendKeyboardEvent", map[string]interface{}{"ref": p.ref.id, "eventType": eventType, "key": key, "modifier": modifier}, nil)
 }
 
 // SetContentAndURL sets the content and URL of the page.
 func (p *WebPage) SetContentAndURL(content, url string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SetContentAndURL", map[string]interface{}{"ref": p.ref.id, "content": content, "url": url}, nil)
+	return p.doJSON("/webpage/SetContentAndURL", map[string]interface{}{"ref": p.ref.id, "content": content, "url": url}, nil)
 }
 
 // Stop stops the web page.
 func (p *WebPage) Stop() error {
-	return p.ref.process.doJSON("POST", "/webpage/Stop", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/Stop", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // SwitchToFocusedFrame changes the current frame to the frame that is in focus.
 func (p *WebPage) SwitchToFocusedFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFocusedFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/SwitchToFocusedFrame", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // SwitchToFrameName changes the current frame to a frame with a given name.
 func (p *WebPage) SwitchToFrameName(name string) error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFrameName", map[string]interface{}{"ref": p.ref.id, "name": name}, nil)
+	return p.doJSON("/webpage/SwitchToFrameName", map[string]interface{}{"ref": p.ref.id, "name": name}, nil)
 }
 
 // SwitchToFramePosition changes the current frame to the frame at the given position.
 func (p *WebPage) SwitchToFramePosition(pos int) error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToFramePosition", map[string]interface{}{"ref": p.ref.id, "position": pos}, nil)
+	return p.doJSON("/webpage/SwitchToFramePosition", map[string]interface{}{"ref": p.ref.id, "position": pos}, nil)
 }
 
 // SwitchToMainFrame switches the current frame to the main frame.
 func (p *WebPage) SwitchToMainFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToMainFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/SwitchToMainFrame", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // SwitchToParentFrame switches the current frame to the parent of the current frame.
 func (p *WebPage) SwitchToParentFrame() error {
-	return p.ref.process.doJSON("POST", "/webpage/SwitchToParentFrame", map[string]interface{}{"ref": p.ref.id}, nil)
+	return p.doJSON("/webpage/SwitchToParentFrame", map[string]interface{}{"ref": p.ref.id}, nil)
 }
 
 // UploadFile uploads a file to a form element specified by selector.
 func (p *WebPage) UploadFile(selector, filename string) error {
-	return p.ref.process.doJSON("POST", "/webpage/UploadFile", map[string]interface{}{"ref": p.ref.id, "selector": selector, "filename": filename}, nil)
+	return p.doJSON("/webpage/UploadFile", map[string]interface{}{"ref": p.ref.id, "selector": selector, "filename": filename}, nil)
 }
 
 // OpenWebPageSettings represents the settings object passed to WebPage.Open().
@@ -955,6 +1704,7 @@ type OpenWebPageSettings struct {
 type Ref struct {
 	process *Process
 	id      string
+	typ     string
 }
 
 // newRef returns a new instance of a referenced object within the process.
@@ -967,25 +1717,201 @@ func (r *Ref) ID() string {
 	return r.id
 }
 
+// Type returns the type of the referenced object (e.g. "webpage").
+// Only set on refs returned from Process.Refs().
+func (r *Ref) Type() string {
+	return r.typ
+}
+
 // refJSON is a struct for encoding refs as JSON.
 type refJSON struct {
-	ID string `json:"id"`
+	ID   string `json:"id"`
+	Type string `json:"type,omitempty"`
+}
+
+// Rect represents a rectangle used by WebPage.ClipRect().
+type Rect struct {
+	Top    int
+	Left   int
+	Width  int
+	Height int
+}
+
+// rectJSON is a struct for encoding rects as JSON.
+type rectJSON struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// RenderFormat represents an output format used by WebPage.Render().
+type RenderFormat string
+
+// Render formats supported by PhantomJS.
+const (
+	RenderFormatPDF  RenderFormat = "pdf"
+	RenderFormatPNG  RenderFormat = "png"
+	RenderFormatJPEG RenderFormat = "jpeg"
+	RenderFormatBMP  RenderFormat = "bmp"
+	RenderFormatPPM  RenderFormat = "ppm"
+	RenderFormatGIF  RenderFormat = "gif"
+)
+
+// normalize returns the lowercase form of the format.
+// The "jpg" alias is converted to "jpeg".
+func (f RenderFormat) normalize() RenderFormat {
+	v := RenderFormat(strings.ToLower(string(f)))
+	if v == "jpg" {
+		return RenderFormatJPEG
+	}
+	return v
+}
+
+// Validate returns an error if the format is not supported by PhantomJS.
+// Formats are matched case-insensitively.
+func (f RenderFormat) Validate() error {
+	switch f.normalize() {
+	case RenderFormatPDF, RenderFormatPNG, RenderFormatJPEG, RenderFormatBMP, RenderFormatPPM, RenderFormatGIF:
+		return nil
+	case "":
+		return fmt.Errorf("%w: format required", ErrInvalidRenderFormat)
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidRenderFormat, string(f))
+	}
+}
+
+// IsRaster returns true if the format is a raster image format.
+func (f RenderFormat) IsRaster() bool {
+	switch f.normalize() {
+	case RenderFormatPNG, RenderFormatJPEG, RenderFormatBMP, RenderFormatPPM, RenderFormatGIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsDecodable returns true if the format can be decoded by WebPage.RenderImage().
+func (f RenderFormat) IsDecodable() bool {
+	return f.IsRaster()
+}
+
+// IsBase64Encodable returns true if the format can be used by WebPage.RenderBase64().
+func (f RenderFormat) IsBase64Encodable() bool {
+	switch f.normalize() {
+	case RenderFormatPNG, RenderFormatJPEG, RenderFormatGIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// RenderOptions represents the options used when rendering a web page.
+type RenderOptions struct {
+	// Output format. Required.
+	Format RenderFormat
+
+	// Image quality from 1 to 100. Zero uses the PhantomJS default.
+	Quality int
+
+	// Area of the page to render. If nil, the page's current clipping
+	// rectangle is used. The previous clipping rectangle is restored after
+	// rendering.
+	ClipRect *Rect
+
+	// Zoom factor used while rendering. Zero uses the page's current zoom
+	// factor. The previous zoom factor is restored after rendering.
+	ZoomFactor float64
+
+	// If true, only the current viewport is rendered.
+	OnlyViewport bool
+
+	// If true, the page is scrolled through its full height before rendering
+	// so that lazily loaded content is present and then the entire document
+	// is rendered. Cannot be combined with ClipRect or OnlyViewport.
+	FullPage bool
+
+	// Maximum height, in pixels, rendered when FullPage is set.
+	// Zero uses DefaultFullPageMaxHeight.
+	MaxHeight int
+
+	// Time to wait for pending resources after each scroll when FullPage is
+	// set. Zero uses DefaultSettleTimeout.
+	SettleTimeout time.Duration
+}
+
+// Validate returns an error if the options are invalid.
+func (opt RenderOptions) Validate() error {
+	if err := opt.Format.Validate(); err != nil {
+		return err
+	}
+	if opt.Quality < 0 || opt.Quality > 100 {
+		return fmt.Errorf("%w: %d", ErrInvalidRenderQuality, opt.Quality)
+	}
+	if opt.ClipRect != nil && (opt.ClipRect.Width <= 0 || opt.ClipRect.Height <= 0) {
+		return fmt.Errorf("%w: %dx%d", ErrInvalidClipRect, opt.ClipRect.Width, opt.ClipRect.Height)
+	}
+	if opt.ZoomFactor < 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidZoomFactor, opt.ZoomFactor)
+	}
+	if opt.FullPage && (opt.ClipRect != nil || opt.OnlyViewport) {
+		return ErrFullPageConflict
+	}
+	if opt.MaxHeight < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidMaxHeight, opt.MaxHeight)
+	}
+	return nil
+}
+
+// ScreenshotElementOptions represents the options used by WebPage.ScreenshotElementWithOptions().
+type ScreenshotElementOptions struct {
+	// Output format. Required.
+	Format RenderFormat
+
+	// Image quality from 1 to 100. Zero uses the PhantomJS default.
+	Quality int
+
+	// Number of pixels to include around each side of the element.
+	// The area is clamped to the top & left edges of the page.
+	Padding int
 }
 
-// Rect represents a rectangle used by WebPage.ClipRect().
-type Rect struct {
-	Top    int
-	Left   int
-	Width  int
-	Height int
+// Validate returns an error if the options are invalid.
+func (opt ScreenshotElementOptions) Validate() error {
+	if err := (RenderOptions{Format: opt.Format, Quality: opt.Quality}).Validate(); err != nil {
+		return err
+	}
+	if opt.Padding < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidPadding, opt.Padding)
+	}
+	return nil
 }
 
-// rectJSON is a struct for encoding rects as JSON.
-type rectJSON struct {
-	Top    int `json:"top"`
-	Left   int `json:"left"`
-	Width  int `json:"width"`
-	Height int `json:"height"`
+// renderOptionsJSON is a struct for encoding render options as JSON.
+type renderOptionsJSON struct {
+	Format       RenderFormat `json:"format"`
+	Quality      int          `json:"quality,omitempty"`
+	ClipRect     *rectJSON    `json:"clipRect,omitempty"`
+	ZoomFactor   float64      `json:"zoomFactor,omitempty"`
+	OnlyViewport bool         `json:"onlyViewport,omitempty"`
+}
+
+func encodeRenderOptionsJSON(v RenderOptions) renderOptionsJSON {
+	out := renderOptionsJSON{
+		Format:       v.Format.normalize(),
+		Quality:      v.Quality,
+		ZoomFactor:   v.ZoomFactor,
+		OnlyViewport: v.OnlyViewport,
+	}
+	if v.ClipRect != nil {
+		out.ClipRect = &rectJSON{
+			Top:    v.ClipRect.Top,
+			Left:   v.ClipRect.Left,
+			Width:  v.ClipRect.Width,
+			Height: v.ClipRect.Height,
+		}
+	}
+	return out
 }
 
 // cookieJSON is a struct for encoding http.Cookie objects as JSON.
@@ -1054,6 +1980,30 @@ type PaperSize struct {
 
 	// Supported orientations: "portrait", "landscape".
 	Orientation string
+
+	// Content repeated at the top & bottom of every page.
+	Header *PaperSizeSection
+	Footer *PaperSizeSection
+}
+
+// Placeholders that can be used within a PaperSizeSection's contents.
+// They are replaced on each page when the PDF is rendered.
+const (
+	PageNumPlaceholder  = "{{pageNum}}"
+	NumPagesPlaceholder = "{{numPages}}"
+	TitlePlaceholder    = "{{title}}"
+	DatePlaceholder     = "{{date}}"
+)
+
+// PaperSizeSection represents a header or footer on a rendered PDF.
+type PaperSizeSection struct {
+	// Height of the section. Uses the same units as PaperSize.
+	Height string
+
+	// HTML template rendered for every page. It may contain the
+	// PageNumPlaceholder, NumPagesPlaceholder, TitlePlaceholder, and
+	// DatePlaceholder placeholders.
+	Contents string
 }
 
 // PaperSizeMargin represents the margins around the paper.
@@ -1065,11 +2015,18 @@ type PaperSizeMargin struct {
 }
 
 type paperSizeJSON struct {
-	Width       string               `json:"width,omitempty"`
-	Height      string               `json:"height,omitempty"`
-	Format      string               `json:"format,omitempty"`
-	Margin      *paperSizeMarginJSON `json:"margin,omitempty"`
-	Orientation string               `json:"orientation,omitempty"`
+	Width       string                `json:"width,omitempty"`
+	Height      string                `json:"height,omitempty"`
+	Format      string                `json:"format,omitempty"`
+	Margin      *paperSizeMarginJSON  `json:"margin,omitempty"`
+	Orientation string                `json:"orientation,omitempty"`
+	Header      *paperSizeSectionJSON `json:"header,omitempty"`
+	Footer      *paperSizeSectionJSON `json:"footer,omitempty"`
+}
+
+type paperSizeSectionJSON struct {
+	Height   string `json:"height"`
+	Contents string `json:"contents"`
 }
 
 type paperSizeMarginJSON struct {
@@ -1094,6 +2051,12 @@ func encodePaperSizeJSON(v PaperSize) paperSizeJSON {
 			Right:  v.Margin.Right,
 		}
 	}
+	if v.Header != nil {
+		out.Header = &paperSizeSectionJSON{Height: v.Header.Height, Contents: v.Header.Contents}
+	}
+	if v.Footer != nil {
+		out.Footer = &paperSizeSectionJSON{Height: v.Footer.Height, Contents: v.Footer.Contents}
+	}
 	return out
 }
 
@@ -1112,6 +2075,12 @@ func decodePaperSizeJSON(v paperSizeJSON) PaperSize {
 			Right:  v.Margin.Right,
 		}
 	}
+	if v.Header != nil {
+		out.Header = &PaperSizeSection{Height: v.Header.Height, Contents: v.Header.Contents}
+	}
+	if v.Footer != nil {
+		out.Footer = &PaperSizeSection{Height: v.Footer.Height, Contents: v.Footer.Contents}
+	}
 	return out
 }
 
@@ -1124,11 +2093,14 @@ type Position struct {
 // WebPageSettings represents various settings on a web page.
 type WebPageSettings struct {
 	JavascriptEnabled             bool
+	JavascriptCanOpenWindows      bool
+	JavascriptCanCloseWindows     bool
 	LoadImages                    bool
 	LocalToRemoteURLAccessEnabled bool
 	UserAgent                     string
 	Username                      string
 	Password                      string
+	MaxAuthAttempts               int
 	XSSAuditingEnabled            bool
 	WebSecurityEnabled            bool
 	ResourceTimeout               time.Duration
@@ -1136,16 +2108,76 @@ type WebPageSettings struct {
 
 type webPageSettingsJSON struct {
 	JavascriptEnabled             bool   `json:"javascriptEnabled"`
+	JavascriptCanOpenWindows      bool   `json:"javascriptCanOpenWindows"`
+	JavascriptCanCloseWindows     bool   `json:"javascriptCanCloseWindows"`
 	LoadImages                    bool   `json:"loadImages"`
 	LocalToRemoteURLAccessEnabled bool   `json:"localToRemoteUrlAccessEnabled"`
 	UserAgent                     string `json:"userAgent"`
-	Username                      string `json:"username"`
+	Username                      string `json:"userName"`
 	Password                      string `json:"password"`
+	MaxAuthAttempts               int    `json:"maxAuthAttempts"`
 	XSSAuditingEnabled            bool   `json:"XSSAuditingEnabled"`
 	WebSecurityEnabled            bool   `json:"webSecurityEnabled"`
 	ResourceTimeout               int    `json:"resourceTimeout"`
 }
 
+func encodeWebPageSettingsJSON(v WebPageSettings) webPageSettingsJSON {
+	return webPageSettingsJSON{
+		JavascriptEnabled:             v.JavascriptEnabled,
+		JavascriptCanOpenWindows:      v.JavascriptCanOpenWindows,
+		JavascriptCanCloseWindows:     v.JavascriptCanCloseWindows,
+		LoadImages:                    v.LoadImages,
+		LocalToRemoteURLAccessEnabled: v.LocalToRemoteURLAccessEnabled,
+		UserAgent:                     v.UserAgent,
+		Username:                      v.Username,
+		Password:                      v.Password,
+		MaxAuthAttempts:               v.MaxAuthAttempts,
+		XSSAuditingEnabled:            v.XSSAuditingEnabled,
+		WebSecurityEnabled:            v.WebSecurityEnabled,
+		ResourceTimeout:               int(v.ResourceTimeout / time.Millisecond),
+	}
+}
+
+func decodeWebPageSettingsJSON(v webPageSettingsJSON) WebPageSettings {
+	return WebPageSettings{
+		JavascriptEnabled:             v.JavascriptEnabled,
+		JavascriptCanOpenWindows:      v.JavascriptCanOpenWindows,
+		JavascriptCanCloseWindows:     v.JavascriptCanCloseWindows,
+		LoadImages:                    v.LoadImages,
+		LocalToRemoteURLAccessEnabled: v.LocalToRemoteURLAccessEnabled,
+		UserAgent:                     v.UserAgent,
+		Username:                      v.Username,
+		Password:                      v.Password,
+		MaxAuthAttempts:               v.MaxAuthAttempts,
+		XSSAuditingEnabled:            v.XSSAuditingEnabled,
+		WebSecurityEnabled:            v.WebSecurityEnabled,
+		ResourceTimeout:               time.Duration(v.ResourceTimeout) * time.Millisecond,
+	}
+}
+
+// diffWebPageSettings returns the JSON fields in b that differ from a.
+func diffWebPageSettings(a, b WebPageSettings) (map[string]interface{}, error) {
+	var prev, next map[string]interface{}
+	if buf, err := json.Marshal(encodeWebPageSettingsJSON(a)); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(buf, &prev); err != nil {
+		return nil, err
+	}
+	if buf, err := json.Marshal(encodeWebPageSettingsJSON(b)); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(buf, &next); err != nil {
+		return nil, err
+	}
+
+	patch := make(map[string]interface{})
+	for key, value := range next {
+		if prev[key] != value {
+			patch[key] = value
+		}
+	}
+	return patch, nil
+}
+
 // shim is the included javascript used to communicate with PhantomJS.
 const shim = `
 var system = require("system")
@@ -1156,92 +2188,236 @@ var webserver = require('webserver');
  * HTTP API
  */
 
-// Serves RPC API.
-var server = webserver.create();
-server.listen(system.env["PORT"], function(request, response) {
-	try {
-		switch (request.url) {
-			case '/ping': return handlePing(request, response);
-			case '/webpage/CanGoBack': return handleWebpageCanGoBack(request, response);
-			case '/webpage/CanGoForward': return handleWebpageCanGoForward(request, response);
-			case '/webpage/ClipRect': return handleWebpageClipRect(request, response);
-			case '/webpage/SetClipRect': return handleWebpageSetClipRect(request, response);
-			case '/webpage/Cookies': return handleWebpageCookies(request, response);
-			case '/webpage/SetCookies': return handleWebpageSetCookies(request, response);
-			case '/webpage/CustomHeaders': return handleWebpageCustomHeaders(request, response);
-			case '/webpage/SetCustomHeaders': return handleWebpageSetCustomHeaders(request, response);
-			case '/webpage/Create': return handleWebpageCreate(request, response);
-			case '/webpage/Content': return handleWebpageContent(request, response);
-			case '/webpage/SetContent': return handleWebpageSetContent(request, response);
-			case '/webpage/FocusedFrameName': return handleWebpageFocusedFrameName(request, response);
-			case '/webpage/FrameContent': return handleWebpageFrameContent(request, response);
-			case '/webpage/SetFrameContent': return handleWebpageSetFrameContent(request, response);
-			case '/webpage/FrameName': return handleWebpageFrameName(request, response);
-			case '/webpage/FramePlainText': return handleWebpageFramePlainText(request, response);
-			case '/webpage/FrameTitle': return handleWebpageFrameTitle(request, response);
-			case '/webpage/FrameURL': return handleWebpageFrameURL(request, response);
-			case '/webpage/FrameCount': return handleWebpageFrameCount(request, response);
-			case '/webpage/FrameNames': return handleWebpageFrameNames(request, response);
-			case '/webpage/LibraryPath': return handleWebpageLibraryPath(request, response);
-			case '/webpage/SetLibraryPath': return handleWebpageSetLibraryPath(request, response);
-			case '/webpage/NavigationLocked': return handleWebpageNavigationLocked(request, response);
-			case '/webpage/SetNavigationLocked': return handleWebpageSetNavigationLocked(request, response);
-			case '/webpage/OfflineStoragePath': return handleWebpageOfflineStoragePath(request, response);
-			case '/webpage/OfflineStorageQuota': return handleWebpageOfflineStorageQuota(request, response);
-			case '/webpage/OwnsPages': return handleWebpageOwnsPages(request, response);
-			case '/webpage/SetOwnsPages': return handleWebpageSetOwnsPages(request, response);
-			case '/webpage/PageWindowNames': return handleWebpagePageWindowNames(request, response);
-			case '/webpage/Pages': return handleWebpagePages(request, response);
-			case '/webpage/PaperSize': return handleWebpagePaperSize(request, response);
-			case '/webpage/SetPaperSize': return handleWebpageSetPaperSize(request, response);
-			case '/webpage/PlainText': return handleWebpagePlainText(request, response);
-			case '/webpage/ScrollPosition': return handleWebpageScrollPosition(request, response);
-			case '/webpage/SetScrollPosition': return handleWebpageSetScrollPosition(request, response);
-			case '/webpage/Settings': return handleWebpageSettings(request, response);
-			case '/webpage/SetSettings': return handleWebpageSetSettings(request, response);
-			case '/webpage/Title': return handleWebpageTitle(request, response);
-			case '/webpage/URL': return handleWebpageURL(request, response);
-			case '/webpage/ViewportSize': return handleWebpageViewportSize(request, response);
-			case '/webpage/SetViewportSize': return handleWebpageSetViewportSize(request, response);
-			case '/webpage/WindowName': return handleWebpageWindowName(request, response);
-			case '/webpage/ZoomFactor': return handleWebpageZoomFactor(request, response);
-			case '/webpage/SetZoomFactor': return handleWebpageSetZoomFactor(request, response);
-
-			case '/webpage/AddCookie': return handleWebpageAddCookie(request, response);
-			case '/webpage/ClearCookies': return handleWebpageClearCookies(request, response);
-			case '/webpage/DeleteCookie': return handleWebpageDeleteCookie(request, response);
-			case '/webpage/Open': return handleWebpageOpen(request, response);
-			case '/webpage/Close': return handleWebpageClose(request, response);
-			case '/webpage/EvaluateAsync': return handleWebpageEvaluateAsync(request, response);
-			case '/webpage/EvaluateJavaScript': return handleWebpageEvaluateJavaScript(request, response);
-			case '/webpage/Evaluate': return handleWebpageEvaluate(request, response);
-			case '/webpage/Page': return handleWebpagePage(request, response);
-			case '/webpage/GoBack': return handleWebpageGoBack(request, response);
-			case '/webpage/GoForward': return handleWebpageGoForward(request, response);
-			case '/webpage/Go': return handleWebpageGo(request, response);
-			case '/webpage/IncludeJS': return handleWebpageIncludeJS(request, response);
-			case '/webpage/InjectJS': return handleWebpageInjectJS(request, response);
-			case '/webpage/Reload': return handleWebpageReload(request, response);
-			case '/webpage/RenderBase64': return handleWebpageRenderBase64(request, response);
-			case '/webpage/Render': return handleWebpageRender(request, response);
-			case '/webpage/SendMouseEvent': return handleWebpageSendMouseEvent(request, response);
-			case '/webpage/SendKeyboardEvent': return handleWebpageSendKeyboardEvent(request, response);
-			case '/webpage/SetContentAndURL': return handleWebpageSetContentAndURL(request, response);
-			case '/webpage/Stop': return handleWebpageStop(request, response);
-			case '/webpage/SwitchToFocusedFrame': return handleWebpageSwitchToFocusedFrame(request, response);
-			case '/webpage/SwitchToFrameName': return handleWebpageSwitchToFrameName(request, response);
-			case '/webpage/SwitchToFramePosition': return handleWebpageSwitchToFramePosition(request, response);
-			case '/webpage/SwitchToMainFrame': return handleWebpageSwitchToMainFrame(request, response);
-			case '/webpage/SwitchToParentFrame': return handleWebpageSwitchToParentFrame(request, response);
-			case '/webpage/UploadFile': return handleWebpageUploadFile(request, response);
-			default: return handleNotFound(request, response);
+// Serves RPC API over stdin/stdout if requested. Otherwise over HTTP.
+if (system.env["TRANSPORT"] === 'pipe') {
+	listenPipe();
+} else {
+	var server = webserver.create();
+	server.listen('127.0.0.1:' + system.env["PORT"], function(request, response) {
+		try {
+			if (!authorized(request)) {
+				return handleUnauthorized(request, response);
+			}
+			route(request, response);
+		} catch(e) {
+			response.statusCode = 500;
+			response.write(JSON.stringify({url: request.url, error: e.message, code: e.code || 'exception'}));
+			response.closeGracefully();
+		}
+	});
+}
+
+// Returns true if the request contains the process token.
+function authorized(request) {
+	var token = system.env["TOKEN"];
+	for (var key in request.headers) {
+		if (key.toLowerCase() === 'x-phantomjs-token') {
+			return !!token && request.headers[key] === token;
 		}
-	} catch(e) {
-		response.statusCode = 500;
-		response.write(JSON.stringify({url: request.url, error: e.message}));
-		response.closeGracefully();
 	}
-});
+	return false;
+}
+
+function handleUnauthorized(request, response) {
+	response.statusCode = 401;
+	response.write(JSON.stringify({error: "unauthorized", code: "unauthorized"}));
+	response.closeGracefully();
+}
+
+// Serves RPC API over stdin/stdout. Each request is read as a JSON line from
+// stdin and each response is written as a prefixed JSON line to stdout so it
+// can be distinguished from other output.
+//
+// PhantomJS has no non-blocking way to read stdin so reading blocks the event
+// loop. The next request is only read once the current request's response has
+// been written and pending events have run.
+function listenPipe() {
+	var prefix = '\x1ephantomjs-rpc:';
+
+	var next = function() {
+		var line = system.stdin.readLine();
+		if (!line) {
+			return phantom.exit(0);
+		}
+
+		var msg = JSON.parse(line);
+		var response = {
+			statusCode: 200,
+			body: '',
+			write: function(s) { this.body += s; },
+			closeGracefully: function() {
+				system.stdout.writeLine(prefix + JSON.stringify({id: msg.id, status: this.statusCode, body: this.body}));
+				system.stdout.flush();
+				setTimeout(next, 0);
+			}
+		};
+
+		try {
+			route({url: msg.path, post: msg.body}, response);
+		} catch(e) {
+			response.statusCode = 500;
+			response.body = JSON.stringify({url: msg.path, error: e.message, code: e.code || 'exception'});
+			response.closeGracefully();
+		}
+	};
+	next();
+}
+
+// Dispatches a request to its handler by URL.
+function route(request, response) {
+	switch (request.url) {
+		case '/ping': return handlePing(request, response);
+		case '/process/AddCookie': return handleProcessAddCookie(request, response);
+		case '/process/ClearCookies': return handleProcessClearCookies(request, response);
+		case '/process/Cookies': return handleProcessCookies(request, response);
+		case '/process/SetCookies': return handleProcessSetCookies(request, response);
+		case '/process/CookiesEnabled': return handleProcessCookiesEnabled(request, response);
+		case '/process/SetCookiesEnabled': return handleProcessSetCookiesEnabled(request, response);
+		case '/process/DeleteCookie': return handleProcessDeleteCookie(request, response);
+		case '/process/Refs': return handleProcessRefs(request, response);
+		case '/ref/Release': return handleRefRelease(request, response);
+		case '/webpage/CanGoBack': return handleWebpageCanGoBack(request, response);
+		case '/webpage/CanGoForward': return handleWebpageCanGoForward(request, response);
+		case '/webpage/ClipRect': return handleWebpageClipRect(request, response);
+		case '/webpage/SetClipRect': return handleWebpageSetClipRect(request, response);
+		case '/webpage/Cookies': return handleWebpageCookies(request, response);
+		case '/webpage/SetCookies': return handleWebpageSetCookies(request, response);
+		case '/webpage/CustomHeaders': return handleWebpageCustomHeaders(request, response);
+		case '/webpage/SetCustomHeaders': return handleWebpageSetCustomHeaders(request, response);
+		case '/webpage/Create': return handleWebpageCreate(request, response);
+		case '/webpage/Content': return handleWebpageContent(request, response);
+		case '/webpage/SetContent': return handleWebpageSetContent(request, response);
+		case '/webpage/FocusedFrameName': return handleWebpageFocusedFrameName(request, response);
+		case '/webpage/FrameContent': return handleWebpageFrameContent(request, response);
+		case '/webpage/SetFrameContent': return handleWebpageSetFrameContent(request, response);
+		case '/webpage/FrameName': return handleWebpageFrameName(request, response);
+		case '/webpage/FramePlainText': return handleWebpageFramePlainText(request, response);
+		case '/webpage/FrameTitle': return handleWebpageFrameTitle(request, response);
+		case '/webpage/FrameURL': return handleWebpageFrameURL(request, response);
+		case '/webpage/FrameCount': return handleWebpageFrameCount(request, response);
+		case '/webpage/FrameNames': return handleWebpageFrameNames(request, response);
+		case '/webpage/LibraryPath': return handleWebpageLibraryPath(request, response);
+		case '/webpage/SetLibraryPath': return handleWebpageSetLibraryPath(request, response);
+		case '/webpage/NavigationLocked': return handleWebpageNavigationLocked(request, response);
+		case '/webpage/SetNavigationLocked': return handleWebpageSetNavigationLocked(request, response);
+		case '/webpage/OfflineStoragePath': return handleWebpageOfflineStoragePath(request, response);
+		case '/webpage/OfflineStorageQuota': return handleWebpageOfflineStorageQuota(request, response);
+		case '/webpage/OwnsPages': return handleWebpageOwnsPages(request, response);
+		case '/webpage/SetOwnsPages': return handleWebpageSetOwnsPages(request, response);
+		case '/webpage/PageWindowNames': return handleWebpagePageWindowNames(request, response);
+		case '/webpage/Pages': return handleWebpagePages(request, response);
+		case '/webpage/PaperSize': return handleWebpagePaperSize(request, response);
+		case '/webpage/SetPaperSize': return handleWebpageSetPaperSize(request, response);
+		case '/webpage/PlainText': return handleWebpagePlainText(request, response);
+		case '/webpage/PendingResourceCount': return handleWebpagePendingResourceCount(request, response);
+		case '/webpage/ScrollPosition': return handleWebpageScrollPosition(request, response);
+		case '/webpage/SetScrollPosition': return handleWebpageSetScrollPosition(request, response);
+		case '/webpage/Settings': return handleWebpageSettings(request, response);
+		case '/webpage/SetSettings': return handleWebpageSetSettings(request, response);
+		case '/webpage/UpdateSettings': return handleWebpageUpdateSettings(request, response);
+		case '/webpage/Title': return handleWebpageTitle(request, response);
+		case '/webpage/URL': return handleWebpageURL(request, response);
+		case '/webpage/ViewportSize': return handleWebpageViewportSize(request, response);
+		case '/webpage/SetViewportSize': return handleWebpageSetViewportSize(request, response);
+		case '/webpage/WindowName': return handleWebpageWindowName(request, response);
+		case '/webpage/ZoomFactor': return handleWebpageZoomFactor(request, response);
+		case '/webpage/SetZoomFactor': return handleWebpageSetZoomFactor(request, response);
+
+		case '/webpage/AddCookie': return handleWebpageAddCookie(request, response);
+		case '/webpage/ClearCookies': return handleWebpageClearCookies(request, response);
+		case '/webpage/DeleteCookie': return handleWebpageDeleteCookie(request, response);
+		case '/webpage/Open': return handleWebpageOpen(request, response);
+		case '/webpage/Close': return handleWebpageClose(request, response);
+		case '/webpage/EvaluateAsync': return handleWebpageEvaluateAsync(request, response);
+		case '/webpage/EvaluateJavaScript': return handleWebpageEvaluateJavaScript(request, response);
+		case '/webpage/AddInitScript': return handleWebpageAddInitScript(request, response);
+		case '/webpage/Emulate': return handleWebpageEmulate(request, response);
+		case '/webpage/SetDeterministic': return handleWebpageSetDeterministic(request, response);
+		case '/webpage/Evaluate': return handleWebpageEvaluate(request, response);
+		case '/webpage/Page': return handleWebpagePage(request, response);
+		case '/webpage/GoBack': return handleWebpageGoBack(request, response);
+		case '/webpage/GoForward': return handleWebpageGoForward(request, response);
+		case '/webpage/Go': return handleWebpageGo(request, response);
+		case '/webpage/IncludeJS': return handleWebpageIncludeJS(request, response);
+		case '/webpage/InjectJS': return handleWebpageInjectJS(request, response);
+		case '/webpage/Reload': return handleWebpageReload(request, response);
+		case '/webpage/Reset': return handleWebpageReset(request, response);
+		case '/webpage/RenderBase64': return handleWebpageRenderBase64(request, response);
+		case '/webpage/Render': return handleWebpageRender(request, response);
+		case '/webpage/ScreenshotElement': return handleWebpageScreenshotElement(request, response);
+		case '/webpage/SendMouseEvent': return handleWebpageSendMouseEvent(request, response);
+		case '/webpage/SendKeyboardEvent': return handleWebpageSendKeyboardEvent(request, response);
+		case '/webpage/SetContentAndURL': return handleWebpageSetContentAndURL(request, response);
+		case '/webpage/Stop': return handleWebpageStop(request, response);
+		case '/webpage/SwitchToFocusedFrame': return handleWebpageSwitchToFocusedFrame(request, response);
+		case '/webpage/SwitchToFrameName': return handleWebpageSwitchToFrameName(request, response);
+		case '/webpage/SwitchToFramePosition': return handleWebpageSwitchToFramePosition(request, response);
+		case '/webpage/SwitchToMainFrame': return handleWebpageSwitchToMainFrame(request, response);
+		case '/webpage/SwitchToParentFrame': return handleWebpageSwitchToParentFrame(request, response);
+		case '/webpage/UploadFile': return handleWebpageUploadFile(request, response);
+		case '/webpage/Batch': return handleWebpageBatch(request, response);
+		default: return handleNotFound(request, response);
+	}
+}
+
+function handleWebpageBatch(request, response) {
+	var msg = JSON.parse(request.post);
+	var results = [];
+
+	// Sends the results of all successful operations and an optional error.
+	var done = function(err) {
+		response.write(JSON.stringify({results: results, error: err}));
+		response.closeGracefully();
+	};
+
+	// Executes each operation in order. Operations can complete
+	// asynchronously so the next operation starts from the callback.
+	var exec = function(i) {
+		if (i >= msg.ops.length) {
+			return done();
+		}
+
+		var op = msg.ops[i];
+		if (op.path === '/webpage/Batch') {
+			return done({index: i, message: 'nested batch not allowed', code: 'bad_request'});
+		}
+
+		var req = op.req || {};
+		req.ref = msg.ref;
+
+		// Captures the handler's response instead of writing it to the client.
+		var opResponse = {
+			statusCode: 200,
+			body: '',
+			write: function(s) { this.body += s; },
+			closeGracefully: function() {
+				var result;
+				try {
+					result = JSON.parse(this.body || '{}');
+				} catch(e) {
+					return done({index: i, message: 'invalid response: ' + this.body, code: 'invalid_response'});
+				}
+				if (this.statusCode >= 400 || result.error) {
+					return done({index: i, message: result.error || ('status ' + this.statusCode), code: result.code || 'exception'});
+				}
+				// Opening a page reports failure in its status so the
+				// remaining operations would run against the wrong page.
+				if (op.path === '/webpage/Open' && result.status !== 'success') {
+					return done({index: i, message: 'failed', code: 'open_failed'});
+				}
+				results.push(result);
+				exec(i + 1);
+			}
+		};
+
+		try {
+			route({url: op.path, post: JSON.stringify(req)}, opResponse);
+		} catch(e) {
+			done({index: i, message: e.message, code: e.code || 'exception'});
+		}
+	};
+	exec(0);
+}
 
 function handlePing(request, response) {
 	response.statusCode = 200;
@@ -1249,6 +2425,69 @@ function handlePing(request, response) {
 	response.closeGracefully();
 }
 
+function handleProcessAddCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var returnValue = phantom.addCookie(msg.cookie);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleProcessClearCookies(request, response) {
+	phantom.clearCookies();
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessCookiesEnabled(request, response) {
+	response.write(JSON.stringify({value: phantom.cookiesEnabled}));
+	response.closeGracefully();
+}
+
+function handleProcessSetCookiesEnabled(request, response) {
+	var msg = JSON.parse(request.post);
+	phantom.cookiesEnabled = msg.value;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessDeleteCookie(request, response) {
+	var msg = JSON.parse(request.post);
+	var returnValue = phantom.deleteCookie(msg.name);
+	response.write(JSON.stringify({returnValue: returnValue}));
+	response.closeGracefully();
+}
+
+function handleProcessCookies(request, response) {
+	response.write(JSON.stringify({value: phantom.cookies}));
+	response.closeGracefully();
+}
+
+function handleProcessSetCookies(request, response) {
+	var msg = JSON.parse(request.post);
+	phantom.cookies = msg.cookies;
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleProcessRefs(request, response) {
+	var a = [];
+	for (var id in refs) {
+		if (refs.hasOwnProperty(id)) {
+			a.push({id: id, type: refs[id].type});
+		}
+	}
+	response.write(JSON.stringify({refs: a}));
+	response.closeGracefully();
+}
+
+function handleRefRelease(request, response) {
+	var msg = JSON.parse(request.post);
+	ref(msg.ref);
+	delete refs[msg.ref];
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
 function handleWebpageCanGoBack(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
 	response.write(JSON.stringify({value: page.canGoBack}));
@@ -1304,7 +2543,21 @@ function handleWebpageSetCustomHeaders(request, response) {
 }
 
 function handleWebpageCreate(request, response) {
-	var ref = createRef(webpage.create());
+	var msg = JSON.parse(request.post || '{}') || {};
+	var page = webpage.create();
+	if (msg.isolateCookies) {
+		page.cookieJar = require('cookiejar').create();
+		page.ownsCookieJar = true;
+	}
+	page.defaults = {
+		settings: JSON.parse(JSON.stringify(page.settings)),
+		viewportSize: page.viewportSize,
+		libraryPath: page.libraryPath
+	};
+	trackResources(page);
+	trackInitialized(page);
+
+	var ref = createRef(page, 'webpage');
 	response.statusCode = 200;
 	response.write(JSON.stringify({ref: ref}));
 	response.closeGracefully();
@@ -1451,31 +2704,95 @@ function handleWebpagePageWindowNames(request, response) {
 
 function handleWebpagePages(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	var refs = page.pages.map(function(p) { return createRef(p); })
+	var refs = page.pages.map(function(p) { return createRef(p, 'webpage'); })
 	response.write(JSON.stringify({refs: refs}));
 	response.closeGracefully();
 }
 
 function handleWebpagePaperSize(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
-	response.write(JSON.stringify({value: page.paperSize}));
+
+	// Return the original header & footer templates instead of callbacks.
+	var value = {};
+	var size = page.paperSize;
+	for (var key in size) {
+		if (size.hasOwnProperty(key) && key !== 'header' && key !== 'footer') {
+			value[key] = size[key];
+		}
+	}
+	var sections = page.paperSizeSections || {};
+	if (sections.header) {
+		value.header = sections.header;
+	}
+	if (sections.footer) {
+		value.footer = sections.footer;
+	}
+
+	response.write(JSON.stringify({value: value}));
 	response.closeGracefully();
 }
 
 function handleWebpageSetPaperSize(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.paperSize = msg.size;
+	var size = msg.size;
+
+	// Convert header & footer templates to callbacks.
+	page.paperSizeSections = {header: size.header, footer: size.footer};
+	if (size.header) {
+		size.header = {height: size.header.height, contents: paperSizeSectionCallback(page, size.header.contents)};
+	}
+	if (size.footer) {
+		size.footer = {height: size.footer.height, contents: paperSizeSectionCallback(page, size.footer.contents)};
+	}
+
+	page.paperSize = size;
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
+// Returns a callback that renders a header or footer template for each page.
+function paperSizeSectionCallback(page, contents) {
+	return phantom.callback(function(pageNum, numPages) {
+		// Placeholders are replaced in a single pass so substituted values
+		// are never expanded or substituted again.
+		var values = {
+			pageNum: pageNum,
+			numPages: numPages,
+			title: escapeHTML(page.title),
+			date: escapeHTML(new Date().toLocaleDateString())
+		};
+		return contents.replace(/\{\{(pageNum|numPages|title|date)\}\}/g, function(match, name) {
+			return String(values[name]);
+		});
+	});
+}
+
+// Escapes special HTML characters in a string.
+function escapeHTML(s) {
+	return String(s)
+		.replace(/&/g, '&amp;')
+		.replace(/</g, '&lt;')
+		.replace(/>/g, '&gt;')
+		.replace(/"/g, '&quot;');
+}
+
 function handleWebpagePlainText(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
 	response.write(JSON.stringify({value: page.plainText}));
 	response.closeGracefully();
 }
 
+function handleWebpagePendingResourceCount(request, response) {
+	var page = ref(JSON.parse(request.post).ref);
+	var n = 0;
+	for (var id in (page.pendingResources || {})) {
+		n++;
+	}
+	response.write(JSON.stringify({value: n}));
+	response.closeGracefully();
+}
+
 function handleWebpageScrollPosition(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
 	var pos = page.scrollPosition;
@@ -1505,6 +2822,18 @@ function handleWebpageSetSettings(request, response) {
 	response.closeGracefully();
 }
 
+function handleWebpageUpdateSettings(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	for (var key in msg.settings) {
+		if (msg.settings.hasOwnProperty(key)) {
+			page.settings[key] = msg.settings[key];
+		}
+	}
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
 function handleWebpageTitle(request, response) {
 	var page = ref(JSON.parse(request.post).ref);
 	response.write(JSON.stringify({value: page.title}));
@@ -1580,17 +2909,18 @@ function handleWebpageDeleteCookie(request, response) {
 function handleWebpageClose(request, response) {
 	var msg = JSON.parse(request.post);
 
-	// Close page.
-	var page = ref(msg.ref);
-	page.close();
-	delete(refs, msg.ref);
-
 	// Close and dereference owned pages.
-	for (var i = 0; i < page.pages.length; i++) {
-		page.pages[i].close();
-		deleteRef(page.pages[i]);
+	var page = ref(msg.ref);
+	var pages = page.pages;
+	for (var i = 0; i < pages.length; i++) {
+		pages[i].close();
+		deleteRef(pages[i]);
 	}
 
+	// Close page.
+	page.close();
+	delete refs[msg.ref];
+
 	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
@@ -1611,6 +2941,43 @@ function handleWebpageEvaluateJavaScript(request, response) {
 	response.closeGracefully();
 }
 
+function handleWebpageAddInitScript(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.initScripts.push(msg.source);
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageSetDeterministic(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	page.deterministic = {seed: msg.seed, timeout: msg.timeout};
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
+function handleWebpageEmulate(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+	var device = msg.device;
+
+	// Scale the viewport by the pixel ratio so the layout width matches the
+	// device's width in CSS pixels.
+	page.viewportSize = {
+		width: Math.round(device.width * device.devicePixelRatio),
+		height: Math.round(device.height * device.devicePixelRatio)
+	};
+	page.zoomFactor = device.devicePixelRatio;
+	if (device.userAgent) {
+		page.settings.userAgent = device.userAgent;
+	}
+	page.emulation = {devicePixelRatio: device.devicePixelRatio, touch: device.touch};
+
+	response.write(JSON.stringify({}));
+	response.closeGracefully();
+}
+
 function handleWebpageEvaluate(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
@@ -1627,7 +2994,7 @@ function handleWebpagePage(request, response) {
 	if (p === null) {
 		response.write(JSON.stringify({}));
 	} else {
-		response.write(JSON.stringify({ref: createRef(p)}));
+		response.write(JSON.stringify({ref: createRef(p, 'webpage')}));
 	}
 	response.closeGracefully();
 }
@@ -1681,20 +3048,162 @@ function handleWebpageReload(request, response) {
 	response.closeGracefully();
 }
 
-function handleWebpageRenderBase64(request, response) {
+function handleWebpageReset(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	var returnValue = page.renderBase64(msg.format);
-	response.write(JSON.stringify({returnValue: returnValue}));
+	var defaults = page.defaults || {};
+
+	// Close and dereference owned pages.
+	var pages = page.pages;
+	for (var i = 0; i < pages.length; i++) {
+		pages[i].close();
+		deleteRef(pages[i]);
+	}
+
+	// Remove event handlers and restore resource tracking.
+	var handlers = [
+		'onAlert', 'onCallback', 'onClosing', 'onConfirm', 'onConsoleMessage',
+		'onError', 'onFilePicker', 'onInitialized', 'onLoadFinished',
+		'onLoadStarted', 'onNavigationRequested', 'onPageCreated', 'onPrompt',
+		'onUrlChanged'
+	];
+	for (var i = 0; i < handlers.length; i++) {
+		page[handlers[i]] = null;
+	}
+	trackResources(page);
+	page.emulation = null;
+	page.deterministic = null;
+	page.initScripts = [];
+	trackInitialized(page);
+
+	page.stop();
+	page.switchToMainFrame();
+	if (page.ownsCookieJar) {
+		page.clearCookies();
+	}
+	page.customHeaders = {};
+	page.navigationLocked = false;
+	page.ownsPages = true;
+	if (defaults.settings) {
+		page.settings = JSON.parse(JSON.stringify(defaults.settings));
+	}
+	if (defaults.viewportSize) {
+		page.viewportSize = defaults.viewportSize;
+	}
+	if (defaults.libraryPath) {
+		page.libraryPath = defaults.libraryPath;
+	}
+	page.clipRect = {top: 0, left: 0, width: 0, height: 0};
+	page.zoomFactor = 1;
+	page.paperSize = {};
+	page.paperSizeSections = null;
+	page.setContent('<html><head></head><body></body></html>', 'about:blank');
+	page.scrollPosition = {top: 0, left: 0};
+
+	response.write(JSON.stringify({}));
 	response.closeGracefully();
 }
 
+function handleWebpageRenderBase64(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+
+	// Wait for the page to settle in deterministic mode.
+	whenStable(page, response, function() {
+		var returnValue = page.renderBase64(msg.format);
+		response.write(JSON.stringify({returnValue: returnValue}));
+		response.closeGracefully();
+	});
+}
+
 function handleWebpageRender(request, response) {
 	var msg = JSON.parse(request.post);
 	var page = ref(msg.ref);
-	page.render(msg.filename, {format: msg.format, quality: msg.quality});
-	response.write(JSON.stringify({}));
-	response.closeGracefully();
+
+	// Wait for the page to settle in deterministic mode.
+	whenStable(page, response, function() {
+		var options = msg.options;
+
+		// Temporarily apply clipping & zoom, if specified.
+		var prevClipRect = page.clipRect;
+		var prevZoomFactor = page.zoomFactor;
+		try {
+			if (options.clipRect) {
+				page.clipRect = options.clipRect;
+			}
+			if (options.zoomFactor) {
+				page.zoomFactor = options.zoomFactor;
+			}
+
+			var renderOptions = {format: options.format, onlyViewport: !!options.onlyViewport};
+			if (options.quality) {
+				renderOptions.quality = options.quality;
+			}
+			page.render(msg.filename, renderOptions);
+		} finally {
+			page.clipRect = prevClipRect;
+			page.zoomFactor = prevZoomFactor;
+		}
+
+		response.write(JSON.stringify({}));
+		response.closeGracefully();
+	});
+}
+
+function handleWebpageScreenshotElement(request, response) {
+	var msg = JSON.parse(request.post);
+	var page = ref(msg.ref);
+
+	// Wait for the page to settle in deterministic mode.
+	whenStable(page, response, function() {
+		// Determine the element's bounds relative to the document.
+		var bounds = page.evaluate(function(selector) {
+			var el = document.querySelector(selector);
+			if (!el) {
+				return null;
+			}
+			var rect = el.getBoundingClientRect();
+			return {
+				top: rect.top + window.pageYOffset,
+				left: rect.left + window.pageXOffset,
+				width: rect.width,
+				height: rect.height
+			};
+		}, msg.selector);
+		if (bounds === null) {
+			response.write(JSON.stringify({found: false}));
+			response.closeGracefully();
+			return;
+		}
+
+		// Expand by padding and scale to the current zoom factor.
+		var zoom = page.zoomFactor;
+		var top = Math.max(0, bounds.top - msg.padding);
+		var left = Math.max(0, bounds.left - msg.padding);
+		var clipRect = {
+			top: Math.floor(top * zoom),
+			left: Math.floor(left * zoom),
+			width: Math.ceil((bounds.left + bounds.width + msg.padding - left) * zoom),
+			height: Math.ceil((bounds.top + bounds.height + msg.padding - top) * zoom)
+		};
+
+		// Render the element's area and restore the previous clipping rectangle.
+		var prevClipRect = page.clipRect;
+		try {
+			page.clipRect = clipRect;
+
+			var renderOptions = {format: msg.options.format};
+			if (msg.options.quality) {
+				renderOptions.quality = msg.options.quality;
+			}
+			page.render(msg.filename, renderOptions);
+		} finally {
+			page.clipRect = prevClipRect;
+		}
+
+		response.write(JSON.stringify({found: true}));
+		response.closeGracefully();
+	});
 }
 
 function handleWebpageSendMouseEvent(request, response) {
@@ -1778,9 +3287,28 @@ function handleWebpageUploadFile(request, response) {
 }
 
 
+// Tracks outstanding resource requests on a page by request id.
+function trackResources(page) {
+	page.pendingResources = {};
+	page.onResourceRequested = function(requestData) {
+		page.pendingResources[requestData.id] = true;
+	};
+	page.onResourceReceived = function(response) {
+		if (response.stage === 'end') {
+			delete page.pendingResources[response.id];
+		}
+	};
+	page.onResourceError = function(resourceError) {
+		delete page.pendingResources[resourceError.id];
+	};
+	page.onResourceTimeout = function(request) {
+		delete page.pendingResources[request.id];
+	};
+}
+
 function handleNotFound(request, response) {
 	response.statusCode = 404;
-	response.write(JSON.stringify({error:"not found"}));
+	response.write(JSON.stringify({error: "not found", code: "not_found"}));
 	response.closeGracefully();
 }
 
@@ -1789,24 +3317,265 @@ function handleNotFound(request, response) {
  * REFS
  */
 
+// Applies page overrides & init scripts each time a page's window object is created.
+function trackInitialized(page) {
+	page.initScripts = page.initScripts || [];
+	page.onInitialized = function() {
+		initializeFrame(page);
+	};
+
+	// Child frames do not trigger onInitialized so they are initialized
+	// once the page has loaded. The signal is connected directly so it is
+	// not replaced by onLoadFinished handlers or removed by Reset().
+	if (!page.initializesChildFrames) {
+		page.initializesChildFrames = true;
+		page.loadFinished.connect(function() {
+			initializeChildFrames(page);
+		});
+	}
+}
+
+// Applies emulation, deterministic mode and init scripts to the window of the
+// page's current frame. Windows that have already been initialized are skipped.
+function initializeFrame(page) {
+	if (!page.evaluate(markInitialized)) {
+		return;
+	}
+	if (page.emulation) {
+		page.evaluate(emulateDevice, page.emulation.devicePixelRatio, page.emulation.touch);
+	}
+	if (page.deterministic) {
+		page.evaluate(seedRandom, page.deterministic.seed);
+		page.evaluate(prepareStableRender);
+	}
+	for (var i = 0; i < page.initScripts.length; i++) {
+		page.evaluate(evalGlobal, page.initScripts[i]);
+	}
+}
+
+// Initializes all child frames of the page that have not been initialized,
+// recursively. The current frame is marked before walking the frames so it
+// can be restored by its position in the frame tree afterward.
+function initializeChildFrames(page) {
+	if (!page.emulation && !page.deterministic && page.initScripts.length === 0) {
+		return;
+	}
+
+	page.evaluate(markCurrentFrame);
+	var path = [], current = null;
+	var walk = function() {
+		for (var i = 0; i < page.framesCount; i++) {
+			if (page.switchToFrame(i)) {
+				path.push(i);
+				var state = page.evaluate(frameState);
+				if (state.current) {
+					current = path.slice();
+				}
+				if (!state.initialized) {
+					initializeFrame(page);
+				}
+				walk();
+				path.pop();
+				page.switchToParentFrame();
+			}
+		}
+	};
+
+	page.switchToMainFrame();
+	page.evaluate(frameState);
+	walk();
+	if (current) {
+		for (var i = 0; i < current.length; i++) {
+			page.switchToFrame(current[i]);
+		}
+	}
+}
+
+// Marks the window of the current frame. Runs within the page.
+function markCurrentFrame() {
+	window.__phantomjsCurrentFrame = true;
+}
+
+// Returns whether the window is marked as the current frame, clearing the
+// mark, and whether it has been initialized. Runs within the page.
+function frameState() {
+	var current = !!window.__phantomjsCurrentFrame;
+	delete window.__phantomjsCurrentFrame;
+	return {current: current, initialized: !!window.__phantomjsInitialized};
+}
+
+// Marks the window as initialized. Returns false if it was already marked.
+// Runs within the page.
+function markInitialized() {
+	if (window.__phantomjsInitialized) {
+		return false;
+	}
+	Object.defineProperty(window, '__phantomjsInitialized', {value: true});
+	return true;
+}
+
+// Evaluates source in the global scope. Runs within the page.
+function evalGlobal(source) {
+	(0, eval)(source);
+}
+
+// Overrides the device pixel ratio & touch support. Runs within the page.
+function emulateDevice(devicePixelRatio, touch) {
+	Object.defineProperty(window, 'devicePixelRatio', {
+		get: function() { return devicePixelRatio; },
+		configurable: true
+	});
+	if (touch) {
+		window.ontouchstart = null;
+		document.ontouchstart = null;
+		Object.defineProperty(navigator, 'maxTouchPoints', {
+			get: function() { return 5; },
+			configurable: true
+		});
+	}
+}
+
+// Replaces Math.random with a seeded generator. Runs within the page.
+function seedRandom(seed) {
+	var state = seed % 4294967296;
+	Math.random = function() {
+		state = (state * 1664525 + 1013904223) % 4294967296;
+		return state / 4294967296;
+	};
+}
+
+// Disables animations, transitions & the text caret. Returns true once the
+// document, its images and its fonts have loaded. Runs within the page.
+function prepareStableRender() {
+	var install = function() {
+		if (document.getElementById('__phantomjs_stable') || !document.documentElement) {
+			return;
+		}
+		var style = document.createElement('style');
+		style.id = '__phantomjs_stable';
+		style.textContent = '*, *::before, *::after {' +
+			'-webkit-animation: none !important; animation: none !important;' +
+			'-webkit-transition: none !important; transition: none !important;' +
+			'caret-color: transparent !important; }';
+		(document.head || document.documentElement).appendChild(style);
+	};
+	install();
+	if (document.readyState === 'loading') {
+		document.addEventListener('DOMContentLoaded', install);
+	}
+
+	// Older versions of WebKit ignore caret-color so remove the caret by
+	// blurring the focused element and clearing any selection.
+	if (document.activeElement && document.activeElement.blur) {
+		document.activeElement.blur();
+	}
+	if (window.getSelection) {
+		window.getSelection().removeAllRanges();
+	}
+
+	if (document.readyState !== 'complete') return false;
+	for (var i = 0; i < document.images.length; i++) {
+		if (!document.images[i].complete) return false;
+	}
+	if (document.fonts) {
+		return document.fonts.status === 'loaded';
+	}
+
+	// Without the font loading API, a web font is considered loaded once text
+	// using it is measured differently than text using its fallback fonts.
+	// Fonts that fail to load are waited on until the timeout.
+	var families = [];
+	for (var i = 0; i < document.styleSheets.length; i++) {
+		var rules;
+		try {
+			rules = document.styleSheets[i].cssRules;
+		} catch(e) {
+			continue; // cross-origin stylesheet
+		}
+		for (var j = 0; rules && j < rules.length; j++) {
+			if (rules[j].type === 5 && rules[j].style) { // CSSRule.FONT_FACE_RULE
+				var family = rules[j].style.getPropertyValue('font-family');
+				if (family) families.push(family);
+			}
+		}
+	}
+	if (families.length === 0 || !document.body) return true;
+
+	var span = document.createElement('span');
+	span.style.cssText = 'position:absolute;top:-9999px;visibility:hidden;font-size:72px;white-space:nowrap';
+	span.textContent = 'mmmmmmmmmmlli10OW';
+	document.body.appendChild(span);
+	var loaded = true;
+	for (var i = 0; i < families.length && loaded; i++) {
+		var changed = false;
+		['monospace', 'serif'].forEach(function(fallback) {
+			span.style.fontFamily = fallback;
+			var width = span.offsetWidth;
+			span.style.fontFamily = families[i] + ', ' + fallback;
+			if (span.offsetWidth !== width) changed = true;
+		});
+		loaded = changed;
+	}
+	document.body.removeChild(span);
+	return loaded;
+}
+
+// Executes fn once the page has loaded & has no pending resources if the page
+// is in deterministic mode, or immediately otherwise. Rendering continues
+// after the page's timeout even if the page has not settled.
+function whenStable(page, response, fn) {
+	if (!page.deterministic) {
+		return fn();
+	}
+
+	var deadline = Date.now() + page.deterministic.timeout;
+	var check = function() {
+		try {
+			var pending = 0;
+			for (var id in (page.pendingResources || {})) {
+				pending++;
+			}
+			var ready = page.evaluate(prepareStableRender);
+			if ((pending === 0 && ready) || Date.now() >= deadline) {
+				return fn();
+			}
+		} catch(e) {
+			response.statusCode = 500;
+			response.write(JSON.stringify({error: e.message, code: e.code || 'exception'}));
+			response.closeGracefully();
+			return;
+		}
+		setTimeout(check, 50);
+	};
+	check();
+}
+
 // Holds references to remote objects.
 var refID = 0;
 var refs = {};
 
-// Adds an object to the reference map and a ref object.
-function createRef(value) {
+// Adds an object to the reference map and returns a ref object.
+// Objects that are already referenced return their existing ref.
+function createRef(value, type) {
 	// Return existing reference, if one exists.
 	for (var key in refs) {
 		if (refs.hasOwnProperty(key)) {
-			if (refs[key] === value) {
-				return key
+			if (refs[key].value === value) {
+				return {id: key};
 			}
 		}
 	}
 
 	// Generate a new id for new references.
 	refID++;
-	refs[refID.toString()] = value;
+	refs[refID.toString()] = {value: value, type: type};
+
+	// Remove the reference once a web page closes, including pages that
+	// are closed by their owner or by calling window.close().
+	if (type === 'webpage' && value.closing) {
+		value.closing.connect(function() { deleteRef(value); });
+	}
+
 	return {id: refID.toString()};
 }
 
@@ -1814,15 +3583,22 @@ function createRef(value) {
 function deleteRef(value) {
 	for (var key in refs) {
 		if (refs.hasOwnProperty(key)) {
-			if (refs[key] === value) {
-				delete(refs, key);
+			if (refs[key].value === value) {
+				delete refs[key];
 			}
 		}
 	}
 }
 
-// Returns a reference object by ID.
+// Returns a referenced object by ID.
+// Throws an error with a "ref_not_found" code if the reference does not exist.
 function ref(id) {
-	return refs[id];
+	var r = refs[id];
+	if (!r) {
+		var err = new Error('ref not found: ' + id);
+		err.code = 'ref_not_found';
+		throw err;
+	}
+	return r.value;
 }
 `
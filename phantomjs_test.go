@@ -2,20 +2,131 @@ package phantomjs_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
 )
 
+// Ensure process can render an HTML document to a PDF.
+func TestProcess_RenderPDF(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("HTML", func(t *testing.T) {
+		buf, err := p.RenderPDF(ctx, `<html><body>INVOICE</body></html>`, phantomjs.PaperSize{Format: "A4"}, "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(buf, []byte("%PDF")) {
+			t.Fatal("expected pdf output")
+		}
+	})
+
+	t.Run("Template", func(t *testing.T) {
+		tmpl := template.Must(template.New("invoice").Parse(`<html><body>{{.}}</body></html>`))
+		buf, err := p.RenderPDFTemplate(ctx, tmpl, "INVOICE", phantomjs.PaperSize{Format: "A4"}, "http://localhost/")
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(buf, []byte("%PDF")) {
+			t.Fatal("expected pdf output")
+		}
+	})
+}
+
+// Ensure process can list live references by type.
+func TestProcess_Refs(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 {
+		t.Fatalf("unexpected ref count: %d", len(refs))
+	} else if refs[0].ID() == "" || refs[0].Type() != "webpage" {
+		t.Fatalf("unexpected ref: id=%q type=%q", refs[0].ID(), refs[0].Type())
+	}
+
+	// Closing the page should remove the reference.
+	MustClosePage(page)
+	if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 0 {
+		t.Fatalf("unexpected ref count: %d", len(refs))
+	}
+}
+
+// Ensure process reports web pages that were never closed.
+func TestProcess_Close_LeakReport(t *testing.T) {
+	var stderr bytes.Buffer
+	p := NewProcess()
+	p.Stderr = &stderr
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create one page that is closed and one that is leaked.
+	MustClosePage(p.MustCreateWebPage())
+	p.MustCreateWebPage()
+
+	p.MustClose()
+	if s := stderr.String(); !strings.Contains(s, "1 web page(s) were never closed") {
+		t.Fatalf("unexpected report: %s", s)
+	} else if !strings.Contains(s, "phantomjs_test.go") {
+		t.Fatalf("expected creation location: %s", s)
+	}
+}
+
+// Ensure process can be closed while requests are in progress.
+func TestProcess_Close_Concurrent(t *testing.T) {
+	p := phantomjstest.NewTransport().NewProcess()
+	p.Stderr = ioutil.Discard
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := page.Evaluate(`function() { return 1; }`); err != nil && err != phantomjs.ErrProcessNotOpen {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
 // Ensure web page can return whether it can navigate forward.
 func TestWebPage_CanGoForward(t *testing.T) {
 	p := MustOpenNewProcess()
@@ -381,6 +492,74 @@ func TestWebPage_FrameURL(t *testing.T) {
 	}
 }
 
+// Ensure web page sessions are isolated from concurrent callers.
+func TestWebPage_Do(t *testing.T) {
+	// Mock external HTTP server.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><frameset rows="*,*"><frame name="FRAME1" src="/frame1.html"/><frame name="FRAME2" src="/frame2.html"/></frameset></html>`))
+		case "/frame1.html":
+			w.Write([]byte(`<html><body>FOO</body></html>`))
+		case "/frame2.html":
+			w.Write([]byte(`<html><body>BAR</body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrently switch frames within sessions while other goroutines
+	// reset the frame outside of a session.
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("FRAME%d", (i%2)+1)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- page.Do(func(page *phantomjs.WebPage) error {
+				if err := page.SwitchToFrameName(name); err != nil {
+					return err
+				}
+				defer page.SwitchToMainFrame()
+
+				if other, err := page.FrameName(); err != nil {
+					return err
+				} else if other != name {
+					return fmt.Errorf("unexpected frame name: %s != %s", other, name)
+				}
+				return nil
+			})
+		}()
+
+		go func() {
+			defer wg.Done()
+			errs <- page.SwitchToMainFrame()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // Ensure web page can retrieve the total frame count.
 func TestWebPage_FrameCount(t *testing.T) {
 	// Mock external HTTP server.
@@ -628,6 +807,258 @@ func TestWebPage_Pages(t *testing.T) {
 	}
 }
 
+// Ensure owned pages keep a stable reference and can be released.
+func TestWebPage_Release(t *testing.T) {
+	// Mock external HTTP server.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a id="link" target="win1" href="/win1.html">CLICK ME</a></body></html>`))
+		case "/win1.html":
+			w.Write([]byte(`<html><body>FOO</body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	if err := page.SetOwnsPages(true); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.EvaluateJavaScript(`function() { document.body.querySelector("#link").click() }`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrieving the same page twice should return the same reference.
+	pages0, err := page.Pages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages1, err := page.Pages()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(pages0) != 1 || len(pages1) != 1 {
+		t.Fatalf("unexpected count: %d, %d", len(pages0), len(pages1))
+	} else if pages0[0].Ref().ID() != pages1[0].Ref().ID() {
+		t.Fatalf("unexpected ref ids: %s != %s", pages0[0].Ref().ID(), pages1[0].Ref().ID())
+	}
+
+	// Releasing the child should remove only its reference.
+	if err := pages0[0].Release(); err != nil {
+		t.Fatal(err)
+	} else if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 {
+		t.Fatalf("unexpected ref count: %d", len(refs))
+	}
+
+	// Releasing the same reference again should fail.
+	if err := pages1[0].Release(); !errors.Is(err, phantomjs.ErrRefNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Closing the owner should release all references.
+	if _, err := page.Pages(); err != nil {
+		t.Fatal(err)
+	}
+	MustClosePage(page)
+	if refs, err := p.Refs(); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 0 {
+		t.Fatalf("unexpected ref count: %d", len(refs))
+	}
+}
+
+// Ensure methods called on closed pages and their children return ErrPageClosed.
+func TestWebPage_Closed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><a id="link" target="win1" href="/win1.html">CLICK ME</a></body></html>`))
+		case "/win1.html":
+			w.Write([]byte(`<html><body>FOO</body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if _, err := page.EvaluateJavaScript(`function() { document.body.querySelector("#link").click() }`); err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := page.Pages()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(pages) != 1 {
+		t.Fatalf("unexpected count: %d", len(pages))
+	}
+	child := pages[0]
+
+	// Closing the owner should also close the child.
+	MustClosePage(page)
+	if !page.Closed() {
+		t.Fatal("expected page to be closed")
+	} else if _, err := page.Title(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := page.Close(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	if _, err := child.Title(); !errors.Is(err, phantomjs.ErrPageClosed) {
+		t.Fatalf("unexpected child error: %v", err)
+	} else if !errors.Is(err, phantomjs.ErrRefNotFound) {
+		t.Fatalf("expected ref not found: %v", err)
+	} else if !child.Closed() {
+		t.Fatal("expected child to be closed")
+	}
+}
+
+// Ensure init scripts run before page scripts on every navigation.
+func TestWebPage_AddInitScript(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.AddInitScript(`var initCount = (window.initCount || 0) + 1;`); err != nil {
+		t.Fatal(err)
+	} else if err := page.AddInitScript(`navigator.__defineGetter__("platform", function() { return "TEST"; });`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Page scripts should see the values set by the init scripts.
+	for i := 0; i < 2; i++ {
+		if err := page.SetContent(`<html><body><script>document.title = initCount + ":" + navigator.platform;</script></body></html>`); err != nil {
+			t.Fatal(err)
+		} else if title, err := page.Title(); err != nil {
+			t.Fatal(err)
+		} else if title != "1:TEST" {
+			t.Fatalf("unexpected title(%d): %q", i, title)
+		}
+	}
+
+	// Resetting the page should remove init scripts.
+	if err := page.Reset(); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetContent(`<html><body><script>document.title = typeof initCount;</script></body></html>`); err != nil {
+		t.Fatal(err)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "undefined" {
+		t.Fatalf("unexpected title after reset: %q", title)
+	}
+}
+
+// Ensure init scripts run once in the main frame and in child frames.
+func TestWebPage_AddInitScript_Frames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<html><body><iframe name="child" src="/child"></iframe></body></html>`))
+		case "/child":
+			w.Write([]byte(`<html><body><iframe src="/grandchild"></iframe></body></html>`))
+		default:
+			w.Write([]byte(`<html><body></body></html>`))
+		}
+	}))
+	defer srv.Close()
+
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if err := page.AddInitScript(`var initCount = (window.initCount || 0) + 1;`); err != nil {
+		t.Fatal(err)
+	} else if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each frame should have run the script exactly once.
+	fn := `function() { return window.initCount; }`
+	if v, err := page.Evaluate(fn); err != nil {
+		t.Fatal(err)
+	} else if v != float64(1) {
+		t.Fatalf("unexpected main frame count: %v", v)
+	}
+	if err := page.SwitchToFramePosition(0); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(fn); err != nil {
+		t.Fatal(err)
+	} else if v != float64(1) {
+		t.Fatalf("unexpected child frame count: %v", v)
+	}
+	if err := page.SwitchToFramePosition(0); err != nil {
+		t.Fatal(err)
+	} else if v, err := page.Evaluate(fn); err != nil {
+		t.Fatal(err)
+	} else if v != float64(1) {
+		t.Fatalf("unexpected grandchild frame count: %v", v)
+	}
+}
+
+// Ensure deterministic pages seed random numbers and render identically.
+func TestWebPage_SetDeterministic(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	const content = `<html><head><style>
+		@keyframes spin { from { transform: rotate(0deg); } to { transform: rotate(360deg); } }
+		div { width: 50px; height: 50px; background: red; animation: spin 1s linear infinite; }
+	</style></head><body><input autofocus><div></div><script>document.title = Math.random();</script></body></html>`
+
+	if err := page.SetViewportSize(200, 100); err != nil {
+		t.Fatal(err)
+	} else if err := page.SetDeterministic(phantomjs.DeterministicOptions{Seed: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render the same content twice with a delay in between.
+	var titles []string
+	var renders []string
+	for i := 0; i < 2; i++ {
+		if err := page.SetContent(content); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Duration(i) * 250 * time.Millisecond)
+
+		title, err := page.Title()
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, title)
+
+		data, err := page.RenderBase64(phantomjs.RenderFormatPNG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		renders = append(renders, data)
+	}
+
+	if titles[0] != titles[1] {
+		t.Fatalf("unexpected random values: %q != %q", titles[0], titles[1])
+	} else if renders[0] != renders[1] {
+		t.Fatal("expected identical renders")
+	}
+}
+
 // Ensure process can set and retrieve the sizing options used for printing.
 func TestWebPage_PaperSize(t *testing.T) {
 	p := MustOpenNewProcess()
@@ -715,6 +1146,68 @@ func TestWebPage_PaperSize(t *testing.T) {
 			t.Fatalf("unexpected size: %#v", other)
 		}
 	})
+
+	// Ensure header & footer templates can be set and rendered.
+	t.Run("HeaderFooter", func(t *testing.T) {
+		page := p.MustCreateWebPage()
+		defer MustClosePage(page)
+
+		sz := phantomjs.PaperSize{
+			Format: "A4",
+			Header: &phantomjs.PaperSizeSection{Height: "1cm", Contents: "<span>" + phantomjs.TitlePlaceholder + "</span>"},
+			Footer: &phantomjs.PaperSizeSection{Height: "1cm", Contents: "<span>" + phantomjs.PageNumPlaceholder + " of " + phantomjs.NumPagesPlaceholder + "</span>"},
+		}
+		if err := page.SetPaperSize(sz); err != nil {
+			t.Fatal(err)
+		}
+		if other, err := page.PaperSize(); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(other, sz) {
+			t.Fatalf("unexpected size: %#v", other)
+		}
+
+		// Render to ensure the callbacks execute without error.
+		if err := page.SetContent(`<html><head><title>TITLE</title></head><body>TEST</body></html>`); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := page.RenderBytes(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPDF}); err != nil {
+			t.Fatal(err)
+		} else if !bytes.HasPrefix(buf, []byte("%PDF")) {
+			t.Fatal("expected pdf output")
+		}
+	})
+
+	// Ensure titles with replacement patterns & placeholders are rendered
+	// literally. The page must render the same as a header with the
+	// expanded title written out by hand.
+	t.Run("HeaderSpecialTitle", func(t *testing.T) {
+		const title = `$& $1 $` + "`" + ` {{pageNum}}`
+		render := func(contents string) []byte {
+			page := p.MustCreateWebPage()
+			defer MustClosePage(page)
+
+			if err := page.SetPaperSize(phantomjs.PaperSize{
+				Format: "A4",
+				Header: &phantomjs.PaperSizeSection{Height: "1cm", Contents: contents},
+			}); err != nil {
+				t.Fatal(err)
+			} else if err := page.SetContent(`<html><head><title>` + title + `</title></head><body>TEST</body></html>`); err != nil {
+				t.Fatal(err)
+			}
+			buf, err := page.RenderBytes(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPDF})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf
+		}
+
+		// PDFs embed a creation date so only compare their sizes.
+		expected := render("<span>" + strings.Replace(title, "{{", "&#123;&#123;", -1) + "</span>")
+		actual := render("<span>" + phantomjs.TitlePlaceholder + "</span>")
+		if len(actual) != len(expected) {
+			t.Fatalf("unexpected pdf size: %d, expected %d", len(actual), len(expected))
+		}
+	})
 }
 
 // Ensure process can retrieve the plain text representation of a page.
@@ -767,11 +1260,14 @@ func TestWebPage_Settings(t *testing.T) {
 	// Set and verify settings.
 	settings := phantomjs.WebPageSettings{
 		JavascriptEnabled:             true,
+		JavascriptCanOpenWindows:      true,
+		JavascriptCanCloseWindows:     true,
 		LoadImages:                    true,
 		LocalToRemoteURLAccessEnabled: true,
 		UserAgent:                     "Mozilla/5.0",
 		Username:                      "susy",
 		Password:                      "pass",
+		MaxAuthAttempts:               3,
 		XSSAuditingEnabled:            true,
 		WebSecurityEnabled:            true,
 		ResourceTimeout:               10 * time.Second,
@@ -786,6 +1282,34 @@ func TestWebPage_Settings(t *testing.T) {
 	}
 }
 
+// Ensure process can update individual page settings.
+func TestWebPage_UpdateSettings(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	prev, err := page.Settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update a single field and verify the remaining fields are unchanged.
+	if err := page.UpdateSettings(func(s *phantomjs.WebPageSettings) {
+		s.LoadImages = !s.LoadImages
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	prev.LoadImages = !prev.LoadImages
+	if other, err := page.Settings(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(other, prev) {
+		t.Fatalf("unexpected settings: %#v", other)
+	}
+}
+
 // Ensure process can retrieve the title of a page.
 func TestWebPage_Title(t *testing.T) {
 	p := MustOpenNewProcess()
@@ -1360,6 +1884,296 @@ func TestWebPage_Render(t *testing.T) {
 	}
 }
 
+// Ensure web page can render to a decoded image with options.
+func TestWebPage_RenderImage(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render a clipped area of the page.
+	img, err := page.RenderImage(phantomjs.RenderOptions{
+		Format:   phantomjs.RenderFormatPNG,
+		ClipRect: &phantomjs.Rect{Width: 40, Height: 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 40 || bounds.Max.Y != 30 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Clipping rectangle should be restored after rendering.
+	if v, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if v != (phantomjs.Rect{}) {
+		t.Fatalf("unexpected clip rect: %#v", v)
+	}
+
+	// Non-raster formats cannot be decoded.
+	if _, err := page.RenderImage(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPDF}); !errors.Is(err, phantomjs.ErrRenderFormatNotSupported) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure web page can render the full document height.
+func TestWebPage_RenderWithOptions_FullPage(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div style="width:100px;height:500px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(100, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render the whole page.
+	img, err := page.RenderImage(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPNG, FullPage: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 500 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Render with a maximum height.
+	img, err = page.RenderImage(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPNG, FullPage: true, MaxHeight: 250})
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 250 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Scroll position should be restored.
+	if pos, err := page.ScrollPosition(); err != nil {
+		t.Fatal(err)
+	} else if pos != (phantomjs.Position{}) {
+		t.Fatalf("unexpected scroll position: %#v", pos)
+	}
+}
+
+// Ensure web page can render the full document when zoomed.
+func TestWebPage_RenderWithOptions_FullPage_ZoomFactor(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div style="width:50px;height:500px;background:#fff"></div><div style="width:50px;height:10px;background:#f00"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(100, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render the whole page at twice the size.
+	img, err := page.RenderImage(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPNG, FullPage: true, ZoomFactor: 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 100 || bounds.Max.Y != 1020 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	} else if r, g, b, _ := img.At(10, 1015).RGBA(); r>>8 != 0xff || g>>8 != 0 || b>>8 != 0 {
+		t.Fatalf("expected bottom of document to be rendered: rgb(%d, %d, %d)", r>>8, g>>8, b>>8)
+	}
+
+	// Zoom factor should be restored.
+	if v, err := page.ZoomFactor(); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Fatalf("unexpected zoom factor: %v", v)
+	}
+}
+
+// Ensure released pages are not reported as leaked when the process closes.
+func TestWebPage_Release_Untracked(t *testing.T) {
+	var stderr bytes.Buffer
+	tr := phantomjstest.NewTransport()
+	p := tr.NewProcess()
+	p.Stderr = &stderr
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.Release(); err != nil {
+		t.Fatal(err)
+	} else if err := p.Close(); err != nil {
+		t.Fatal(err)
+	} else if stderr.Len() != 0 {
+		t.Fatalf("unexpected leak report: %s", stderr.String())
+	}
+}
+
+// Ensure releasing a page the process does not reference returns an error.
+func TestWebPage_Release_ErrRefNotFound(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.HandleError("/ref/Release", phantomjs.ErrRefNotFound)
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.Release(); !errors.Is(err, phantomjs.ErrRefNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a failure to restore the zoom factor after a full page render is returned.
+func TestWebPage_RenderWithOptions_FullPage_RestoreError(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.Handle("/webpage/ViewportSize", func(json.RawMessage) (interface{}, error) {
+		return map[string]int{"width": 100, "height": 100}, nil
+	})
+	tr.HandleValue("/webpage/ZoomFactor", 1)
+	tr.Handle("/webpage/Evaluate", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"returnValue": 50}, nil
+	})
+	tr.Handle("/webpage/SetZoomFactor", func(req json.RawMessage) (interface{}, error) {
+		var v struct {
+			Value float64 `json:"value"`
+		}
+		if err := json.Unmarshal(req, &v); err != nil {
+			return nil, err
+		} else if v.Value == 1 {
+			return nil, errors.New("marker")
+		}
+		return nil, nil
+	})
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	var rerr *phantomjs.RemoteError
+	if err := page.RenderWithOptions(filepath.Join(p.Path(), "out.png"), phantomjs.RenderOptions{Format: phantomjs.RenderFormatPNG, FullPage: true, ZoomFactor: 2}); !errors.As(err, &rerr) || rerr.Message != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if n := len(tr.CallsTo("/webpage/Render")); n != 0 {
+		t.Fatalf("unexpected render count: %d", n)
+	}
+}
+
+// Ensure web page can render a PDF to bytes.
+func TestWebPage_RenderBytes(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><head></head><body>TEST</body></html>`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render page and verify PDF header.
+	buf, err := page.RenderBytes(phantomjs.RenderOptions{Format: phantomjs.RenderFormatPDF})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(buf, []byte("%PDF")) {
+		t.Fatalf("unexpected pdf header: %q", buf[:10])
+	}
+}
+
+// Ensure web page can render a single element by selector.
+func TestWebPage_ScreenshotElement(t *testing.T) {
+	// Start process.
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Create & open page.
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+	if err := page.SetContent(`<html><body style="margin:0"><div id="box" style="position:absolute;top:20px;left:30px;width:40px;height:50px"></div></body></html>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := page.SetViewportSize(200, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set a clipping rectangle that should be preserved.
+	rect := phantomjs.Rect{Width: 100, Height: 100}
+	if err := page.SetClipRect(rect); err != nil {
+		t.Fatal(err)
+	}
+
+	// Render element with padding.
+	buf, err := page.ScreenshotElementWithOptions("#box", phantomjs.ScreenshotElementOptions{Format: phantomjs.RenderFormatPNG, Padding: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	} else if bounds := img.Bounds(); bounds.Max.X != 50 || bounds.Max.Y != 60 {
+		t.Fatalf("unexpected image dimesions: %dx%d", bounds.Max.X, bounds.Max.Y)
+	}
+
+	// Verify clipping rectangle is restored.
+	if v, err := page.ClipRect(); err != nil {
+		t.Fatal(err)
+	} else if v != rect {
+		t.Fatalf("unexpected clip rect: %#v", v)
+	}
+
+	// Missing elements should return an error.
+	if _, err := page.ScreenshotElement("#missing", phantomjs.RenderFormatPNG); !errors.Is(err, phantomjs.ErrElementNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure render options are validated before being sent to the process.
+func TestRenderOptions_Validate(t *testing.T) {
+	for i, tt := range []struct {
+		opt phantomjs.RenderOptions
+		err error
+	}{
+		{opt: phantomjs.RenderOptions{Format: phantomjs.RenderFormatPNG}},
+		{opt: phantomjs.RenderOptions{Format: "PDF", Quality: 100}},
+		{opt: phantomjs.RenderOptions{Format: "jpg", ZoomFactor: 2}},
+		{opt: phantomjs.RenderOptions{}, err: phantomjs.ErrInvalidRenderFormat},
+		{opt: phantomjs.RenderOptions{Format: "pgn"}, err: phantomjs.ErrInvalidRenderFormat},
+		{opt: phantomjs.RenderOptions{Format: "png", Quality: 101}, err: phantomjs.ErrInvalidRenderQuality},
+		{opt: phantomjs.RenderOptions{Format: "png", Quality: -1}, err: phantomjs.ErrInvalidRenderQuality},
+		{opt: phantomjs.RenderOptions{Format: "png", ClipRect: &phantomjs.Rect{Width: 10}}, err: phantomjs.ErrInvalidClipRect},
+		{opt: phantomjs.RenderOptions{Format: "png", ZoomFactor: -1}, err: phantomjs.ErrInvalidZoomFactor},
+		{opt: phantomjs.RenderOptions{Format: "png", FullPage: true, MaxHeight: 1000}},
+		{opt: phantomjs.RenderOptions{Format: "png", FullPage: true, OnlyViewport: true}, err: phantomjs.ErrFullPageConflict},
+		{opt: phantomjs.RenderOptions{Format: "png", FullPage: true, ClipRect: &phantomjs.Rect{Width: 1, Height: 1}}, err: phantomjs.ErrFullPageConflict},
+		{opt: phantomjs.RenderOptions{Format: "png", MaxHeight: -1}, err: phantomjs.ErrInvalidMaxHeight},
+	} {
+		if err := tt.opt.Validate(); !errors.Is(err, tt.err) {
+			t.Errorf("%d. unexpected error: %v", i, err)
+		}
+	}
+}
+
 // Ensure web page can receive mouse events.
 func TestWebPage_SendMouseEvent(t *testing.T) {
 	// Start process.
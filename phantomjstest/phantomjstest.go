@@ -0,0 +1,175 @@
+// Package phantomjstest provides helpers for testing code that uses the
+// phantomjs package, including a fake Transport, golden screenshot assertions
+// and helpers that manage processes, pages and fixture servers for a test.
+package phantomjstest
+
+import (
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// BinPath is the path to the phantomjs binary used by the helpers.
+// Defaults to the PHANTOMJS_BIN environment variable, if set.
+var BinPath = phantomjs.DefaultBinPath
+
+func init() {
+	if v := os.Getenv("PHANTOMJS_BIN"); v != "" {
+		BinPath = v
+	}
+}
+
+// shared holds the process shared by all tests in the test binary.
+var shared struct {
+	once    sync.Once
+	process *phantomjs.Process
+	err     error
+}
+
+// Main runs the tests and then closes the shared process, if it was opened.
+// Call it from TestMain so the process does not outlive the test binary:
+//
+//	func TestMain(m *testing.M) { phantomjstest.Main(m) }
+func Main(m *testing.M) {
+	code := m.Run()
+	if shared.process != nil {
+		shared.process.Close()
+	}
+	os.Exit(code)
+}
+
+// SkipIfUnavailable skips the test if the phantomjs binary cannot be found.
+func SkipIfUnavailable(tb testing.TB) {
+	tb.Helper()
+	if _, err := exec.LookPath(BinPath); err != nil {
+		tb.Skipf("phantomjs binary not available: %s", BinPath)
+	}
+}
+
+// SharedProcess returns a process that is shared by all tests in the test
+// binary. The process is opened on first use. Skips the test if the phantomjs
+// binary is not available.
+func SharedProcess(tb testing.TB) *phantomjs.Process {
+	tb.Helper()
+	SkipIfUnavailable(tb)
+
+	shared.once.Do(func() {
+		p, err := newProcess()
+		if err != nil {
+			shared.err = err
+		} else if shared.err = p.Open(); shared.err == nil {
+			shared.process = p
+		}
+	})
+	if shared.err != nil {
+		tb.Fatalf("open shared process: %s", shared.err)
+	}
+	return shared.process
+}
+
+// OpenProcess opens a new process that is closed when the test completes.
+// Skips the test if the phantomjs binary is not available.
+func OpenProcess(tb testing.TB) *phantomjs.Process {
+	tb.Helper()
+	SkipIfUnavailable(tb)
+
+	p, err := newProcess()
+	if err != nil {
+		tb.Fatalf("open process: %s", err)
+	} else if err := p.Open(); err != nil {
+		tb.Fatalf("open process: %s", err)
+	}
+	tb.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			tb.Errorf("close process: %s", err)
+		}
+	})
+	return p
+}
+
+// newProcess returns a process that uses BinPath and the default transport.
+// Each process listens on a free port so it does not compete with other
+// processes, including those in other test binaries running in parallel.
+func newProcess() (*phantomjs.Process, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	p := phantomjs.NewProcess()
+	p.BinPath = BinPath
+	p.Port = port
+	return p, nil
+}
+
+// freePort returns a loopback port that is not currently in use.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// CreateWebPage creates a page on p that is closed when the test completes.
+func CreateWebPage(tb testing.TB, p *phantomjs.Process) *phantomjs.WebPage {
+	tb.Helper()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		tb.Fatalf("create web page: %s", err)
+	}
+	tb.Cleanup(func() {
+		if err := page.Close(); err != nil && !errors.Is(err, phantomjs.ErrPageClosed) {
+			tb.Errorf("close web page: %s", err)
+		}
+	})
+	return page
+}
+
+// NewWebPage creates a page on the shared process that is closed when the
+// test completes. Skips the test if the phantomjs binary is not available.
+func NewWebPage(tb testing.TB) *phantomjs.WebPage {
+	tb.Helper()
+	return CreateWebPage(tb, SharedProcess(tb))
+}
+
+// NewServer starts an HTTP server for h that is closed when the test completes.
+func NewServer(tb testing.TB, h http.Handler) *httptest.Server {
+	tb.Helper()
+	s := httptest.NewServer(h)
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// NewFixtureServer starts an HTTP server that serves files from a map of
+// request paths to contents (e.g. "/index.html"). The content type is
+// determined by the path's extension and defaults to HTML. Other paths return
+// a 404. The server is closed when the test completes.
+func NewFixtureServer(tb testing.TB, files map[string]string) *httptest.Server {
+	tb.Helper()
+	return NewServer(tb, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(r.URL.Path))
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+}
@@ -0,0 +1,100 @@
+package phantomjstest_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+func TestMain(m *testing.M) { phantomjstest.Main(m) }
+
+// Ensure pages can be created on the shared process.
+func TestNewWebPage(t *testing.T) {
+	srv := phantomjstest.NewFixtureServer(t, map[string]string{
+		"/index.html": `<html><head><title>FIXTURE</title></head></html>`,
+	})
+
+	page := phantomjstest.NewWebPage(t)
+	if err := page.Open(srv.URL + "/index.html"); err != nil {
+		t.Fatal(err)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "FIXTURE" {
+		t.Fatalf("unexpected title: %q", title)
+	}
+
+	// The same process should be shared between tests.
+	if phantomjstest.SharedProcess(t) != phantomjstest.SharedProcess(t) {
+		t.Fatal("expected shared process")
+	}
+}
+
+// Ensure processes can run alongside each other without sharing a port.
+func TestOpenProcess(t *testing.T) {
+	p0, p1 := phantomjstest.OpenProcess(t), phantomjstest.OpenProcess(t)
+	if p0.Port == p1.Port {
+		t.Fatalf("expected different ports: %d", p0.Port)
+	}
+	for _, p := range []*phantomjs.Process{p0, p1, phantomjstest.SharedProcess(t)} {
+		if _, ok := p.Transport.(*phantomjs.HTTPTransport); !ok {
+			t.Fatalf("unexpected transport: %T", p.Transport)
+		} else if page := phantomjstest.CreateWebPage(t, p); page == nil {
+			t.Fatal("expected page")
+		}
+	}
+}
+
+// Ensure tests are skipped when the binary cannot be found.
+func TestSkipIfUnavailable(t *testing.T) {
+	prev := phantomjstest.BinPath
+	phantomjstest.BinPath = "/no/such/phantomjs"
+	defer func() { phantomjstest.BinPath = prev }()
+
+	var reached bool
+	t.Run("Skip", func(t *testing.T) {
+		phantomjstest.NewWebPage(t)
+		reached = true
+	})
+	if reached {
+		t.Fatal("expected test to be skipped")
+	}
+}
+
+// Ensure fixture server serves files by path with content types.
+func TestNewFixtureServer(t *testing.T) {
+	srv := phantomjstest.NewFixtureServer(t, map[string]string{
+		"/":         "<html></html>",
+		"/app.css":  "body {}",
+		"/data.txt": "DATA",
+	})
+
+	for _, tt := range []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/", http.StatusOK, "text/html; charset=utf-8", "<html></html>"},
+		{"/app.css", http.StatusOK, "text/css; charset=utf-8", "body {}"},
+		{"/missing.html", http.StatusNotFound, "text/plain; charset=utf-8", "404 page not found\n"},
+	} {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if resp.StatusCode != tt.status {
+			t.Fatalf("%s: unexpected status: %d", tt.path, resp.StatusCode)
+		} else if v := resp.Header.Get("Content-Type"); v != tt.contentType {
+			t.Fatalf("%s: unexpected content type: %s", tt.path, v)
+		} else if string(body) != tt.body {
+			t.Fatalf("%s: unexpected body: %q", tt.path, body)
+		}
+	}
+}
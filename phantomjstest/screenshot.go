@@ -0,0 +1,144 @@
+package phantomjstest
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// ScreenshotOptions represents options for AssertScreenshotWithOptions().
+type ScreenshotOptions struct {
+	// Maximum difference allowed for a single pixel, from 0 to 1. The
+	// difference is the largest change of any color channel.
+	Threshold float64
+
+	// If true, anti-aliased edges are not counted as differences.
+	IgnoreAntiAliasing bool
+
+	// Areas of the screenshot that are not compared, in pixels.
+	Ignore []image.Rectangle
+
+	// Options used to render the page. The format is always PNG.
+	Render phantomjs.RenderOptions
+
+	// If true, the golden file is rewritten with the rendered image.
+	// The golden file is also rewritten if the PHANTOMJSTEST_UPDATE
+	// environment variable is set. Tests can set it from their own flag:
+	//
+	//	var update = flag.Bool("update", false, "update golden files")
+	//
+	//	phantomjstest.AssertScreenshotWithOptions(t, page, path, phantomjstest.ScreenshotOptions{Update: *update})
+	Update bool
+}
+
+// AssertScreenshot renders page as a PNG and compares it to the golden file
+// at goldenPath. Pixels may differ by up to tolerance, from 0 to 1.
+//
+// On failure, the rendered image and a diff image highlighting the changed
+// pixels are written next to the golden file. Set the PHANTOMJSTEST_UPDATE
+// environment variable to replace the golden file with the rendered image.
+func AssertScreenshot(tb testing.TB, page *phantomjs.WebPage, goldenPath string, tolerance float64) {
+	tb.Helper()
+	AssertScreenshotWithOptions(tb, page, goldenPath, ScreenshotOptions{Threshold: tolerance})
+}
+
+// AssertScreenshotWithOptions renders page and compares it to the golden
+// file at goldenPath using opt. See AssertScreenshot() for details.
+func AssertScreenshotWithOptions(tb testing.TB, page *phantomjs.WebPage, goldenPath string, opt ScreenshotOptions) {
+	tb.Helper()
+
+	renderOptions := opt.Render
+	renderOptions.Format = phantomjs.RenderFormatPNG
+	buf, err := page.RenderBytes(renderOptions)
+	if err != nil {
+		tb.Fatalf("render screenshot: %s", err)
+		return
+	}
+
+	// Overwrite the golden file when updating.
+	if opt.Update || os.Getenv("PHANTOMJSTEST_UPDATE") != "" {
+		if err := os.MkdirAll(filepath.Dir(goldenPath), 0777); err != nil {
+			tb.Fatal(err)
+			return
+		} else if err := ioutil.WriteFile(goldenPath, buf, 0666); err != nil {
+			tb.Fatal(err)
+			return
+		}
+		tb.Logf("updated golden screenshot: %s", goldenPath)
+		return
+	}
+
+	actual, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		tb.Fatalf("decode screenshot: %s", err)
+		return
+	}
+	expected, err := readPNG(goldenPath)
+	if os.IsNotExist(err) {
+		tb.Fatalf("golden screenshot not found, run with PHANTOMJSTEST_UPDATE=1 to create: %s", goldenPath)
+		return
+	} else if err != nil {
+		tb.Fatalf("read golden screenshot: %s", err)
+		return
+	}
+
+	// Compare images and write the rendered & diff images on failure.
+	result, err := phantomjs.DiffImages(expected, actual, phantomjs.DiffOptions{
+		Threshold:          opt.Threshold,
+		IgnoreAntiAliasing: opt.IgnoreAntiAliasing,
+		Ignore:             opt.Ignore,
+	})
+	if err == phantomjs.ErrImageSizeMismatch {
+		writeFailure(tb, goldenPath, buf, nil)
+		tb.Errorf("screenshot size mismatch: %s: got %v, expected %v", goldenPath, actual.Bounds().Size(), expected.Bounds().Size())
+		return
+	} else if err != nil {
+		tb.Fatalf("diff screenshot: %s", err)
+		return
+	} else if result.ChangedPixels > 0 {
+		writeFailure(tb, goldenPath, buf, result.Image)
+		tb.Errorf("screenshot mismatch: %s: %d pixel(s) differ in %v", goldenPath, result.ChangedPixels, result.Regions)
+	}
+}
+
+// writeFailure writes the rendered screenshot and, if available, the diff
+// image next to the golden file.
+func writeFailure(tb testing.TB, goldenPath string, actual []byte, diff image.Image) {
+	tb.Helper()
+
+	base := strings.TrimSuffix(goldenPath, filepath.Ext(goldenPath))
+	if err := ioutil.WriteFile(base+".actual.png", actual, 0666); err != nil {
+		tb.Logf("write actual screenshot: %s", err)
+	} else {
+		tb.Logf("actual screenshot: %s", base+".actual.png")
+	}
+
+	if diff == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, diff); err != nil {
+		tb.Logf("encode diff image: %s", err)
+	} else if err := ioutil.WriteFile(base+".diff.png", buf.Bytes(), 0666); err != nil {
+		tb.Logf("write diff image: %s", err)
+	} else {
+		tb.Logf("diff image: %s", base+".diff.png")
+	}
+}
+
+// readPNG reads and decodes a PNG file.
+func readPNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
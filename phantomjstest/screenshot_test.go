@@ -0,0 +1,132 @@
+package phantomjstest_test
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure screenshots are compared against golden files.
+func TestAssertScreenshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phantomjstest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Render a solid image with a single changed pixel.
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	goldenPath := filepath.Join(dir, "golden.png")
+	MustWritePNG(goldenPath, img)
+	img.Set(5, 5, color.RGBA{250, 250, 250, 255})
+
+	tr := phantomjstest.NewTransport()
+	tr.Handle("/webpage/Render", func(req json.RawMessage) (interface{}, error) {
+		var v struct {
+			Filename string `json:"filename"`
+		}
+		if err := json.Unmarshal(req, &v); err != nil {
+			return nil, err
+		}
+		MustWritePNG(v.Filename, img)
+		return nil, nil
+	})
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		tb := &RecordingTB{TB: t}
+		phantomjstest.AssertScreenshot(tb, page, goldenPath, 0.1)
+		if tb.failed {
+			t.Fatal("expected screenshot to match")
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		tb := &RecordingTB{TB: t}
+		phantomjstest.AssertScreenshot(tb, page, goldenPath, 0)
+		if !tb.failed {
+			t.Fatal("expected screenshot mismatch")
+		} else if _, err := os.Stat(filepath.Join(dir, "golden.diff.png")); err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(filepath.Join(dir, "golden.actual.png")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Ignore", func(t *testing.T) {
+		tb := &RecordingTB{TB: t}
+		phantomjstest.AssertScreenshotWithOptions(tb, page, goldenPath, phantomjstest.ScreenshotOptions{
+			Ignore: []image.Rectangle{image.Rect(4, 4, 6, 6)},
+		})
+		if tb.failed {
+			t.Fatal("expected ignored pixel to match")
+		}
+	})
+
+	t.Run("MissingGolden", func(t *testing.T) {
+		tb := &RecordingTB{TB: t}
+		phantomjstest.AssertScreenshot(tb, page, filepath.Join(dir, "missing.png"), 0)
+		if !tb.failed {
+			t.Fatal("expected missing golden failure")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		tb := &RecordingTB{TB: t}
+		updatePath := filepath.Join(dir, "update", "golden.png")
+		phantomjstest.AssertScreenshotWithOptions(tb, page, updatePath, phantomjstest.ScreenshotOptions{Update: true})
+		if tb.failed {
+			t.Fatal("unexpected update failure")
+		}
+
+		// The rewritten golden file should match the rendered image.
+		phantomjstest.AssertScreenshot(tb, page, updatePath, 0)
+		if tb.failed {
+			t.Fatal("expected updated screenshot to match")
+		}
+	})
+}
+
+// RecordingTB wraps testing.TB and records failures instead of failing the test.
+type RecordingTB struct {
+	testing.TB
+	failed bool
+}
+
+func (tb *RecordingTB) Error(args ...interface{})                 { tb.failed = true }
+func (tb *RecordingTB) Errorf(format string, args ...interface{}) { tb.failed = true }
+func (tb *RecordingTB) Fatal(args ...interface{})                 { tb.failed = true }
+func (tb *RecordingTB) Fatalf(format string, args ...interface{}) { tb.failed = true }
+
+// MustWritePNG writes img to filename as a PNG. Panic on error.
+func MustWritePNG(filename string, img image.Image) {
+	f, err := os.Create(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		panic(err)
+	}
+}
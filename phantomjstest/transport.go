@@ -0,0 +1,156 @@
+package phantomjstest
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure Transport implements the interface.
+var _ phantomjs.Transport = (*Transport)(nil)
+
+// HandlerFunc returns a scripted response for a request.
+// The returned value is encoded as the JSON response. If an error is
+// returned then it is passed back to the caller as a *phantomjs.RemoteError.
+// Returning phantomjs.ErrRefNotFound simulates a missing reference.
+type HandlerFunc func(req json.RawMessage) (interface{}, error)
+
+// Transport is an in-memory phantomjs.Transport that does not start a
+// PhantomJS process. It records every call and returns scripted responses so
+// code using this package can be tested without the phantomjs binary.
+//
+// Paths without a handler return an empty object. "/webpage/Create" returns
+// a new ref for each call unless a handler is registered.
+type Transport struct {
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+	calls    []Call
+	refID    int
+}
+
+// NewTransport returns a new instance of Transport.
+func NewTransport() *Transport {
+	return &Transport{handlers: make(map[string]HandlerFunc)}
+}
+
+// NewProcess returns a new Process that uses t as its transport.
+// The process must still be opened before use.
+func (t *Transport) NewProcess() *phantomjs.Process {
+	p := phantomjs.NewProcess()
+	p.Transport = t
+	return p
+}
+
+// Handle registers fn as the handler for path (e.g. "/webpage/Title").
+func (t *Transport) Handle(path string, fn HandlerFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers[path] = fn
+}
+
+// HandleValue registers a handler that always returns {"value": v} for path.
+// This matches the response format of the shim's property getters.
+func (t *Transport) HandleValue(path string, v interface{}) {
+	t.Handle(path, func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"value": v}, nil
+	})
+}
+
+// HandleError registers a handler that always returns err for path.
+// See HandlerFunc for how errors are encoded.
+func (t *Transport) HandleError(path string, err error) {
+	t.Handle(path, func(json.RawMessage) (interface{}, error) {
+		return nil, err
+	})
+}
+
+// Calls returns a list of all calls made to the transport, in order.
+func (t *Transport) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Call(nil), t.calls...)
+}
+
+// CallsTo returns a list of calls made to path, in order.
+func (t *Transport) CallsTo(path string) []Call {
+	var a []Call
+	for _, call := range t.Calls() {
+		if call.Path == path {
+			a = append(a, call)
+		}
+	}
+	return a
+}
+
+// Reset clears all recorded calls. Handlers are kept.
+func (t *Transport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = nil
+}
+
+// Open is a no-op as no process is started.
+func (t *Transport) Open(p *phantomjs.Process) error { return nil }
+
+// Close is a no-op.
+func (t *Transport) Close() error { return nil }
+
+// Do records the call and returns the scripted response for path.
+func (t *Transport) Do(path string, body []byte) ([]byte, error) {
+	t.mu.Lock()
+	t.calls = append(t.calls, Call{Path: path, Request: append(json.RawMessage(nil), body...)})
+	fn := t.handlers[path]
+	if fn == nil && path == "/webpage/Create" {
+		t.refID++
+		fn = createHandler(strconv.Itoa(t.refID))
+	}
+	t.mu.Unlock()
+
+	if fn == nil {
+		return []byte("{}"), nil
+	}
+
+	v, err := fn(json.RawMessage(body))
+	if err != nil {
+		return json.Marshal(encodeError(err))
+	} else if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// encodeError converts err to the shim's error response format.
+// A *phantomjs.RemoteError keeps its code & message and ErrRefNotFound uses
+// the ref not found code. All other errors are returned as exceptions.
+func encodeError(err error) map[string]string {
+	var remoteErr *phantomjs.RemoteError
+	switch {
+	case errors.As(err, &remoteErr):
+		return map[string]string{"error": remoteErr.Message, "code": remoteErr.Code}
+	case errors.Is(err, phantomjs.ErrRefNotFound):
+		return map[string]string{"error": err.Error(), "code": phantomjs.ErrorCodeRefNotFound}
+	default:
+		return map[string]string{"error": err.Error(), "code": phantomjs.ErrorCodeException}
+	}
+}
+
+// createHandler returns a handler that returns a web page ref with id.
+func createHandler(id string) HandlerFunc {
+	return func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"ref": map[string]string{"id": id}}, nil
+	}
+}
+
+// Call represents a single request sent through a Transport.
+type Call struct {
+	Path    string
+	Request json.RawMessage
+}
+
+// Decode unmarshals the call's request body into v.
+func (c Call) Decode(v interface{}) error {
+	return json.Unmarshal(c.Request, v)
+}
@@ -0,0 +1,186 @@
+package phantomjstest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/benbjohnson/phantomjs"
+	"github.com/benbjohnson/phantomjs/phantomjstest"
+)
+
+// Ensure transport records calls and returns scripted responses.
+func TestTransport(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.HandleValue("/webpage/Title", "TITLE")
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	if err := page.SetViewportSize(100, 200); err != nil {
+		t.Fatal(err)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "TITLE" {
+		t.Fatalf("unexpected title: %q", title)
+	}
+
+	// Verify the viewport request was recorded.
+	calls := tr.CallsTo("/webpage/SetViewportSize")
+	if len(calls) != 1 {
+		t.Fatalf("unexpected call count: %d", len(calls))
+	}
+	var req struct {
+		Ref    string `json:"ref"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+	if err := calls[0].Decode(&req); err != nil {
+		t.Fatal(err)
+	} else if req.Ref != page.Ref().ID() || req.Width != 100 || req.Height != 200 {
+		t.Fatalf("unexpected request: %#v", req)
+	}
+}
+
+// Ensure transport returns scripted errors to the caller.
+func TestTransport_HandleError(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.HandleError("/webpage/Open", errors.New("marker"))
+	tr.Handle("/webpage/Evaluate", func(req json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"returnValue": 42}, nil
+	})
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	var remoteErr *phantomjs.RemoteError
+	if err := page.Open("http://example.com"); !errors.As(err, &remoteErr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if remoteErr.Endpoint != "/webpage/Open" || remoteErr.Message != "marker" || remoteErr.Code != phantomjs.ErrorCodeException {
+		t.Fatalf("unexpected remote error: %#v", remoteErr)
+	} else if v, err := page.Evaluate(`function() {}`); err != nil {
+		t.Fatal(err)
+	} else if v != float64(42) {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
+// Ensure missing references are returned as closed pages.
+func TestTransport_HandleError_RefNotFound(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.HandleError("/webpage/Title", phantomjs.ErrRefNotFound)
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	if _, err := page.Title(); !errors.Is(err, phantomjs.ErrPageClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.Is(err, phantomjs.ErrRefNotFound) {
+		t.Fatalf("expected ref not found: %v", err)
+	}
+}
+
+// Ensure closed pages return an error without calling the transport.
+func TestTransport_ClosedPage(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := page.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := page.Title(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := page.Close(); err != phantomjs.ErrPageClosed {
+		t.Fatalf("unexpected close error: %v", err)
+	} else if calls := tr.CallsTo("/webpage/Title"); len(calls) != 0 {
+		t.Fatalf("unexpected call count: %d", len(calls))
+	} else if calls := tr.CallsTo("/webpage/Close"); len(calls) != 1 {
+		t.Fatalf("unexpected close call count: %d", len(calls))
+	}
+}
+
+// Ensure only changed settings are sent when updating settings.
+func TestTransport_UpdateSettings(t *testing.T) {
+	tr := phantomjstest.NewTransport()
+	tr.Handle("/webpage/Settings", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"settings": map[string]interface{}{
+			"javascriptEnabled": true,
+			"loadImages":        true,
+			"userAgent":         "Mozilla/5.0",
+		}}, nil
+	})
+
+	p := tr.NewProcess()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.CreateWebPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+
+	if err := page.UpdateSettings(func(s *phantomjs.WebPageSettings) {
+		s.LoadImages = false
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := tr.CallsTo("/webpage/UpdateSettings")
+	if len(calls) != 1 {
+		t.Fatalf("unexpected call count: %d", len(calls))
+	}
+	var req struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := calls[0].Decode(&req); err != nil {
+		t.Fatal(err)
+	} else if len(req.Settings) != 1 || req.Settings["loadImages"] != false {
+		t.Fatalf("unexpected settings: %#v", req.Settings)
+	}
+
+	// Unchanged settings should not send a request.
+	if err := page.UpdateSettings(func(s *phantomjs.WebPageSettings) {}); err != nil {
+		t.Fatal(err)
+	} else if calls := tr.CallsTo("/webpage/UpdateSettings"); len(calls) != 1 {
+		t.Fatalf("unexpected call count: %d", len(calls))
+	}
+}
@@ -0,0 +1,379 @@
+package phantomjs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrPoolClosed is returned when acquiring a page from a closed pool.
+	ErrPoolClosed = errors.New("pool closed")
+
+	// ErrPageNotInPool is returned when releasing a page that was not
+	// acquired from the pool.
+	ErrPageNotInPool = errors.New("page not in pool")
+
+	// ErrPoolOpen is returned when opening a pool that is already open.
+	ErrPoolOpen = errors.New("pool already open")
+
+	// ErrInvalidPoolSize is returned when opening a pool without processes.
+	ErrInvalidPoolSize = errors.New("invalid pool size")
+)
+
+// Default pool settings.
+const (
+	DefaultPoolSize           = 4
+	DefaultMaxPagesPerProcess = 8
+)
+
+// Pool manages a set of PhantomJS processes and hands out web pages from them.
+//
+// Each process listens on its own port, starting at Port. Processes are
+// recycled once they have created MaxPagesBeforeRecycle pages or once their
+// memory usage exceeds MaxMemory so that long running programs do not
+// accumulate leaks inside PhantomJS. Recycled processes are restarted in the
+// background and restart failures are written to Stderr.
+type Pool struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup // background restarts
+	slots  []*poolSlot
+	pages  map[*WebPage]*poolSlot
+	notify chan struct{}
+	opened bool
+
+	// Number of processes to run. Must be greater than zero.
+	Size int
+
+	// First HTTP port used by the processes.
+	// Each process uses the next port after the previous process.
+	Port int
+
+	// Maximum number of pages open on a single process at one time.
+	MaxPagesPerProcess int
+
+	// Number of pages a process can create before it is restarted.
+	// If zero, processes are not recycled by page count.
+	MaxPagesBeforeRecycle int
+
+	// Memory usage, in bytes, after which a process is restarted.
+	// If zero, processes are not recycled by memory usage.
+	// Memory usage is only available on Linux.
+	MaxMemory int64
+
+	// Path to the 'phantomjs' binary.
+	BinPath string
+
+	// Output from the processes.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewPool returns a new instance of Pool.
+func NewPool() *Pool {
+	return &Pool{
+		Size:               DefaultPoolSize,
+		Port:               DefaultPort,
+		MaxPagesPerProcess: DefaultMaxPagesPerProcess,
+		BinPath:            DefaultBinPath,
+		Stdout:             os.Stdout,
+		Stderr:             os.Stderr,
+	}
+}
+
+// Open starts all processes in the pool.
+// Returns ErrPoolOpen if the pool is already open.
+func (p *Pool) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.opened {
+		return ErrPoolOpen
+	} else if p.Size <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidPoolSize, p.Size)
+	}
+
+	p.pages = make(map[*WebPage]*poolSlot)
+	p.notify = make(chan struct{})
+	p.opened = true
+
+	for i := 0; i < p.Size; i++ {
+		process, err := p.openProcess(p.Port + i)
+		if err != nil {
+			p.close()
+			return err
+		}
+		p.slots = append(p.slots, &poolSlot{port: p.Port + i, process: process})
+	}
+	return nil
+}
+
+// Close stops all processes in the pool.
+// Pages that have not been released are closed along with their process.
+// Blocks until background restarts have finished.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	err := p.close()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+func (p *Pool) close() (err error) {
+	if p.opened {
+		p.opened = false
+		close(p.notify)
+	}
+
+	for _, slot := range p.slots {
+		if slot.process == nil {
+			continue
+		}
+		if e := slot.process.Close(); e != nil && err == nil {
+			err = e
+		}
+		slot.process = nil
+	}
+	p.slots, p.pages = nil, nil
+
+	return err
+}
+
+// Acquire returns a new web page from the process with the fewest open pages.
+// Blocks until a process has capacity or until ctx is done.
+func (p *Pool) Acquire(ctx context.Context) (*WebPage, error) {
+	for {
+		p.mu.Lock()
+		if !p.opened {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		// Restart a dead process if one exists. Otherwise use the least
+		// loaded process that has capacity.
+		if slot := p.deadSlot(); slot != nil {
+			slot.restarting = true
+			p.mu.Unlock()
+
+			if err := p.restartSlot(slot); err != nil {
+				return nil, err
+			}
+			continue
+		} else if slot := p.availableSlot(); slot != nil {
+			slot.active++
+			slot.total++
+			if p.MaxPagesBeforeRecycle > 0 && slot.total >= p.MaxPagesBeforeRecycle {
+				slot.draining = true
+			}
+			process := slot.process
+			p.mu.Unlock()
+
+			page, err := process.CreateWebPage()
+			if err != nil {
+				p.mu.Lock()
+				slot.active--
+				slot.draining = true
+				p.broadcast()
+				p.mu.Unlock()
+				p.recycle(slot)
+				return nil, err
+			}
+
+			p.mu.Lock()
+			p.pages[page] = slot
+			p.mu.Unlock()
+			return page, nil
+		}
+
+		// Wait for a page to be released.
+		notify := p.notify
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// Release closes page and returns its capacity to the pool.
+// The page's process is restarted in the background if it has exceeded its
+// limits.
+func (p *Pool) Release(page *WebPage) error {
+	p.mu.Lock()
+	if !p.opened {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	}
+	slot, ok := p.pages[page]
+	if !ok {
+		p.mu.Unlock()
+		return ErrPageNotInPool
+	}
+	delete(p.pages, page)
+	p.mu.Unlock()
+
+	// Pages that were already closed by the caller are not an error.
+	err := page.Close()
+	if errors.Is(err, ErrPageClosed) {
+		err = nil
+	}
+
+	p.mu.Lock()
+	slot.active--
+	if err != nil || p.exceedsLimits(slot) {
+		slot.draining = true
+	}
+	p.broadcast()
+	p.mu.Unlock()
+
+	p.recycle(slot)
+	return err
+}
+
+// recycle restarts slot's process in the background if it is draining and has
+// no open pages. If the restart fails then the error is written to Stderr and
+// the process is started again by the next call to Acquire().
+func (p *Pool) recycle(slot *poolSlot) {
+	p.mu.Lock()
+	if !p.opened || !slot.draining || slot.restarting || slot.active > 0 {
+		p.mu.Unlock()
+		return
+	}
+	slot.restarting = true
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		if err := p.restartSlot(slot); err != nil && err != ErrPoolClosed && p.Stderr != nil {
+			fmt.Fprintf(p.Stderr, "phantomjs: restart process on port %d: %s\n", slot.port, err)
+		}
+	}()
+}
+
+// restartSlot closes the slot's process, if any, and opens a new one.
+// The slot must be marked as restarting by the caller.
+func (p *Pool) restartSlot(slot *poolSlot) error {
+	p.mu.Lock()
+	prev := slot.process
+	slot.process = nil
+	p.mu.Unlock()
+
+	if prev != nil {
+		prev.Close()
+	}
+	process, err := p.openProcess(slot.port)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slot.restarting, slot.draining, slot.total = false, false, 0
+	if err == nil && !p.opened {
+		process.Close()
+		err = ErrPoolClosed
+	} else if err == nil {
+		slot.process = process
+	}
+	p.broadcast()
+	return err
+}
+
+// openProcess starts a new process on port using the pool's settings.
+func (p *Pool) openProcess(port int) (*Process, error) {
+	process := NewProcess()
+	process.BinPath = p.BinPath
+	process.Port = port
+	process.Stdout = p.Stdout
+	process.Stderr = p.Stderr
+	if err := process.Open(); err != nil {
+		return nil, err
+	}
+	return process, nil
+}
+
+// deadSlot returns a slot without a running process, if any.
+func (p *Pool) deadSlot() *poolSlot {
+	for _, slot := range p.slots {
+		if slot.process == nil && !slot.restarting {
+			return slot
+		}
+	}
+	return nil
+}
+
+// availableSlot returns the least loaded slot that can accept a new page.
+func (p *Pool) availableSlot() *poolSlot {
+	var best *poolSlot
+	for _, slot := range p.slots {
+		if slot.process == nil || slot.restarting || slot.draining {
+			continue
+		} else if p.MaxPagesPerProcess > 0 && slot.active >= p.MaxPagesPerProcess {
+			continue
+		} else if best == nil || slot.active < best.active {
+			best = slot
+		}
+	}
+	return best
+}
+
+// exceedsLimits returns true if slot's process should be recycled.
+func (p *Pool) exceedsLimits(slot *poolSlot) bool {
+	if p.MaxPagesBeforeRecycle > 0 && slot.total >= p.MaxPagesBeforeRecycle {
+		return true
+	}
+	if p.MaxMemory > 0 && slot.process != nil && slot.process.cmd != nil {
+		if n, err := processMemory(slot.process.cmd.Process.Pid); err == nil && n > p.MaxMemory {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast wakes all goroutines waiting in Acquire().
+func (p *Pool) broadcast() {
+	if !p.opened {
+		return
+	}
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// poolSlot represents a single process position within a pool.
+type poolSlot struct {
+	port    int
+	process *Process
+
+	active     int  // number of open pages
+	total      int  // number of pages created since start
+	draining   bool // no new pages; restart once active is zero
+	restarting bool // process is being started
+}
+
+// processMemory returns the resident memory, in bytes, of the process with pid.
+// Only supported on systems that provide /proc.
+func processMemory(pid int) (int64, error) {
+	buf, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/statm")
+	if err != nil {
+		return 0, err
+	}
+
+	// The second field is the resident set size in pages.
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return 0, errors.New("invalid statm format")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
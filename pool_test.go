@@ -0,0 +1,148 @@
+package phantomjs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure pool blocks acquisition when all processes are at capacity.
+func TestPool_Acquire_MaxPagesPerProcess(t *testing.T) {
+	p := MustOpenNewPool(func(p *phantomjs.Pool) {
+		p.Size = 1
+		p.MaxPagesPerProcess = 1
+	})
+	defer p.MustClose()
+
+	page, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Second acquisition should wait until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Releasing the page should allow another acquisition.
+	if err := p.Release(page); err != nil {
+		t.Fatal(err)
+	}
+	if page, err := p.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := p.Release(page); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure pool restarts a process after it creates too many pages.
+func TestPool_Release_MaxPagesBeforeRecycle(t *testing.T) {
+	p := MustOpenNewPool(func(p *phantomjs.Pool) {
+		p.Size = 1
+		p.MaxPagesBeforeRecycle = 2
+	})
+	defer p.MustClose()
+
+	for i := 0; i < 5; i++ {
+		page, err := p.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := page.Evaluate(`function() { return 1 }`); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Release(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure releasing an unknown page returns an error.
+func TestPool_Release_ErrPageNotInPool(t *testing.T) {
+	p := MustOpenNewPool(func(p *phantomjs.Pool) { p.Size = 1 })
+	defer p.MustClose()
+
+	if err := p.Release(&phantomjs.WebPage{}); err != phantomjs.ErrPageNotInPool {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a pool cannot be opened twice.
+func TestPool_Open_ErrPoolOpen(t *testing.T) {
+	p := MustOpenNewPool(func(p *phantomjs.Pool) { p.Size = 1 })
+	defer p.MustClose()
+
+	if err := p.Open(); err != phantomjs.ErrPoolOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a pool without processes cannot be opened.
+func TestPool_Open_ErrInvalidPoolSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		p := phantomjs.NewPool()
+		p.Size = size
+		if err := p.Open(); !errors.Is(err, phantomjs.ErrInvalidPoolSize) {
+			t.Fatalf("unexpected error(%d): %v", size, err)
+		}
+	}
+}
+
+// Ensure release does not wait for a recycled process and that restart
+// failures are reported.
+func TestPool_Release_RestartError(t *testing.T) {
+	var stderr bytes.Buffer
+	p := MustOpenNewPool(func(p *phantomjs.Pool) {
+		p.Size = 1
+		p.MaxPagesBeforeRecycle = 1
+		p.Stderr = &stderr
+	})
+
+	page, err := p.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting the process will fail once the binary cannot be found.
+	p.BinPath = "/no/such/phantomjs"
+	if err := p.Release(page); err != nil {
+		t.Fatal(err)
+	}
+	p.MustClose()
+
+	if !strings.Contains(stderr.String(), "restart process") {
+		t.Fatalf("expected restart error: %q", stderr.String())
+	}
+}
+
+// Pool is a test wrapper for phantomjs.Pool.
+type Pool struct {
+	*phantomjs.Pool
+}
+
+// MustOpenNewPool returns a new, open Pool. Panic on error.
+// The optional fn can be used to modify the pool before it is opened.
+func MustOpenNewPool(fn func(p *phantomjs.Pool)) *Pool {
+	p := &Pool{Pool: phantomjs.NewPool()}
+	if fn != nil {
+		fn(p.Pool)
+	}
+	if err := p.Open(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// MustClose closes the pool. Panic on error.
+func (p *Pool) MustClose() {
+	if err := p.Close(); err != nil {
+		panic(err)
+	}
+}
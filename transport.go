@@ -0,0 +1,377 @@
+package phantomjs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Transport represents the channel used by a Process to start and communicate
+// with the shim script running inside PhantomJS.
+type Transport interface {
+	// Open starts the shim for p and blocks until it is ready to receive
+	// requests. The shim script is available at p.Path()/shim.js.
+	Open(p *Process) error
+
+	// Close releases any resources held by the transport.
+	// The PhantomJS process itself is stopped by Process.Close().
+	Close() error
+
+	// Do sends a JSON encoded request body to an API path (e.g.
+	// "/webpage/Open") and returns the JSON encoded response body.
+	Do(path string, body []byte) ([]byte, error)
+}
+
+// ProcessExitedError is returned by a transport when a request cannot be
+// delivered to the process or its response cannot be read because the process
+// is no longer running.
+type ProcessExitedError struct {
+	Err error // underlying transport error
+}
+
+// Error returns the error message.
+func (e *ProcessExitedError) Error() string {
+	return ErrProcessExited.Error() + ": " + e.Err.Error()
+}
+
+// Is returns true if target is ErrProcessExited.
+func (e *ProcessExitedError) Is(target error) bool {
+	return target == ErrProcessExited
+}
+
+// Unwrap returns the underlying error.
+func (e *ProcessExitedError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPTransport communicates with the shim over HTTP on Process.Port.
+// This is the default transport.
+//
+// The shim only listens on the loopback interface and rejects requests that
+// do not include the process token in the X-PhantomJS-Token header.
+type HTTPTransport struct {
+	process *Process
+
+	// HTTP client used to send requests.
+	// Defaults to http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// NewHTTPTransport returns a new instance of HTTPTransport.
+func NewHTTPTransport() *HTTPTransport {
+	return &HTTPTransport{}
+}
+
+// Open starts the phantomjs binary with the shim listening on p.Port and
+// waits until it responds.
+func (t *HTTPTransport) Open(p *Process) error {
+	t.process = p
+	env := []string{fmt.Sprintf("PORT=%d", p.Port), "TOKEN=" + p.Token()}
+	if err := p.start(env, nil, p.Stdout); err != nil {
+		return err
+	}
+	return t.wait()
+}
+
+// Close is a no-op for HTTP transports.
+func (t *HTTPTransport) Close() error { return nil }
+
+// Do sends body to the shim's HTTP server at path.
+func (t *HTTPTransport) Do(path string, body []byte) ([]byte, error) {
+	// Create request.
+	httpRequest, err := t.newRequest("POST", path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	// Send request.
+	httpResponse, err := t.client().Do(httpRequest)
+	if err != nil {
+		return nil, classifyHTTPError(err)
+	}
+	defer httpResponse.Body.Close()
+
+	// Read response body. Errors are encoded in the body by the shim.
+	buf, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, classifyHTTPError(err)
+	}
+	return buf, nil
+}
+
+// classifyHTTPError wraps err in a *ProcessExitedError if it indicates that
+// the shim's server is no longer running. Other errors, such as timeouts and
+// canceled requests, are returned unchanged.
+func classifyHTTPError(err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &ProcessExitedError{Err: err}
+	}
+	return err
+}
+
+// newRequest returns a new HTTP request to path that includes the process token.
+func (t *HTTPTransport) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, t.process.URL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-PhantomJS-Token", t.process.Token())
+	return req, nil
+}
+
+// client returns the HTTP client used to send requests.
+func (t *HTTPTransport) client() *http.Client {
+	if t.Client != nil {
+		return t.Client
+	}
+	return http.DefaultClient
+}
+
+// wait continually checks the process until it gets a response or times out.
+func (t *HTTPTransport) wait() error {
+	ticker := time.NewTicker(1000 * time.Millisecond)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return errors.New("timeout")
+		case <-ticker.C:
+			if err := t.ping(); err == nil {
+				return nil
+			}
+		}
+	}
+}
+
+// ping checks the process to see if it is up.
+func (t *HTTPTransport) ping() error {
+	// Send request.
+	req, err := t.newRequest("GET", "/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Verify successful status code.
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pipeResponsePrefix marks lines on stdout that are RPC responses.
+const pipeResponsePrefix = "\x1ephantomjs-rpc:"
+
+// PipeTransport communicates with the shim over the child process' stdin and
+// stdout instead of a TCP port. Requests are sent as JSON lines on stdin and
+// responses are read from prefixed lines on stdout. All other output is
+// forwarded to Process.Stdout. Since the pipes are only reachable by the
+// parent process, requests do not require the process token.
+//
+// PipeTransport is experimental. PhantomJS can only read stdin by blocking its
+// event loop so, while no request is in progress, pages do not load and their
+// timers do not fire. Requests that wait on the page, such as WebPage.Open(),
+// still complete since the event loop runs until they respond. Use the
+// HTTPTransport when pages must make progress between requests.
+type PipeTransport struct {
+	mu      sync.Mutex // serializes requests
+	nextID  int
+	pending int32 // number of requests waiting for or holding mu
+
+	stdin     *os.File
+	stdout    *os.File
+	responses chan pipeResponseJSON
+	done      chan struct{} // closed when stdout is closed
+	closing   chan struct{} // closed when the transport is closed
+	closeOnce sync.Once
+
+	// Interval between keep-alive requests sent while the transport is
+	// idle so that pages can make progress between requests. Each keep-alive
+	// is a full request so short intervals are costly. Zero, the default,
+	// disables keep-alives.
+	KeepAlive time.Duration
+}
+
+// NewPipeTransport returns a new instance of PipeTransport.
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{}
+}
+
+// Open starts the phantomjs binary with the shim reading from stdin and waits
+// until it responds.
+func (t *PipeTransport) Open(p *Process) error {
+	// The child's ends of the pipes are closed once it starts so reads
+	// and writes fail when the child exits.
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return err
+	}
+	t.stdin, t.stdout = stdinW, stdoutR
+	t.responses = make(chan pipeResponseJSON)
+	t.done = make(chan struct{})
+	t.closing = make(chan struct{})
+
+	err = p.start([]string{"TRANSPORT=pipe"}, stdinR, stdoutW)
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		t.Close()
+		return err
+	}
+	go t.read(p.Stdout)
+
+	// Wait until the shim responds.
+	ch := make(chan error, 1)
+	go func() { _, err := t.Do("/ping", nil); ch <- err }()
+	select {
+	case err := <-ch:
+		if err != nil {
+			return err
+		}
+	case <-time.After(30 * time.Second):
+		return errors.New("timeout")
+	}
+
+	if t.KeepAlive > 0 {
+		go t.keepAlive()
+	}
+	return nil
+}
+
+// Close closes the child's stdin and stops reading from its stdout.
+func (t *PipeTransport) Close() error {
+	t.closeOnce.Do(func() {
+		if t.closing != nil {
+			close(t.closing)
+		}
+		if t.stdin != nil {
+			t.stdin.Close()
+		}
+		if t.stdout != nil {
+			t.stdout.Close()
+		}
+	})
+	return nil
+}
+
+// Do sends body to path over stdin and waits for the matching response.
+func (t *PipeTransport) Do(path string, body []byte) ([]byte, error) {
+	atomic.AddInt32(&t.pending, 1)
+	defer atomic.AddInt32(&t.pending, -1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	id := t.nextID
+
+	// Encode request as a single line. JSON encoding escapes newlines.
+	frame, err := json.Marshal(pipeRequestJSON{ID: id, Path: path, Body: string(body)})
+	if err != nil {
+		return nil, err
+	} else if _, err := t.stdin.Write(append(frame, '\n')); err != nil {
+		return nil, &ProcessExitedError{Err: err}
+	}
+
+	// Wait for response, discarding any stale responses.
+	for {
+		select {
+		case resp := <-t.responses:
+			if resp.ID != id {
+				continue
+			}
+			return []byte(resp.Body), nil
+		case <-t.done:
+			return nil, &ProcessExitedError{Err: errors.New("pipe closed")}
+		}
+	}
+}
+
+// read processes lines from the child's stdout. Response lines are passed to
+// the waiting request and all other lines are written to w.
+func (t *PipeTransport) read(w io.Writer) {
+	defer close(t.done)
+
+	r := bufio.NewReader(t.stdout)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, pipeResponsePrefix) {
+			var resp pipeResponseJSON
+			if e := json.Unmarshal([]byte(strings.TrimPrefix(line, pipeResponsePrefix)), &resp); e == nil {
+				select {
+				case t.responses <- resp:
+				case <-t.closing:
+					return
+				}
+			}
+		} else if line != "" && w != nil {
+			w.Write([]byte(line))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// keepAlive periodically pings the shim so its event loop is not blocked on
+// stdin for long periods. Pings are skipped while other requests are pending
+// since the event loop is already running.
+func (t *PipeTransport) keepAlive() {
+	ticker := time.NewTicker(t.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&t.pending) == 0 {
+				t.Do("/ping", nil)
+			}
+		}
+	}
+}
+
+// pipeRequestJSON is a struct for encoding requests sent over stdin.
+type pipeRequestJSON struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+	Body string `json:"body"`
+}
+
+// pipeResponseJSON is a struct for decoding responses read from stdout.
+type pipeResponseJSON struct {
+	ID     int    `json:"id"`
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
@@ -0,0 +1,132 @@
+package phantomjs_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/phantomjs"
+)
+
+// Ensure a process can communicate with the shim over stdin/stdout.
+func TestPipeTransport(t *testing.T) {
+	// Mock external HTTP server.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>TITLE</title></head><body>FOO</body></html>`))
+	}))
+	defer srv.Close()
+
+	p := NewProcess()
+	p.Port = 0
+	p.Transport = phantomjs.NewPipeTransport()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	// Asynchronous handlers should complete over the pipe.
+	if err := page.Open(srv.URL); err != nil {
+		t.Fatal(err)
+	} else if title, err := page.Title(); err != nil {
+		t.Fatal(err)
+	} else if title != "TITLE" {
+		t.Fatalf("unexpected title: %q", title)
+	}
+
+	// Large payloads should be framed correctly.
+	if v, err := page.Evaluate(`function() { return new Array(100001).join("x") }`); err != nil {
+		t.Fatal(err)
+	} else if s, _ := v.(string); len(s) != 100000 {
+		t.Fatalf("unexpected length: %d", len(s))
+	}
+}
+
+// Ensure requests fail with ErrProcessExited after the child process is killed.
+func TestTransport_ProcessExited(t *testing.T) {
+	for _, name := range []string{"http", "pipe"} {
+		t.Run(name, func(t *testing.T) {
+			p := NewProcess()
+			if name == "pipe" {
+				p.Transport = phantomjs.NewPipeTransport()
+			}
+			if err := p.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			page := p.MustCreateWebPage()
+
+			// Kill the child and wait for it to exit.
+			proc, err := os.FindProcess(p.Pid())
+			if err != nil {
+				t.Fatal(err)
+			} else if err := proc.Kill(); err != nil {
+				t.Fatal(err)
+			}
+			proc.Wait()
+
+			if _, err := page.Title(); !errors.Is(err, phantomjs.ErrProcessExited) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Ensure HTTP client timeouts are not reported as the process exiting.
+func TestHTTPTransport_Timeout(t *testing.T) {
+	p := NewProcess()
+	p.Transport = &phantomjs.HTTPTransport{Client: &http.Client{Timeout: 500 * time.Millisecond}}
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.MustClose()
+
+	page := p.MustCreateWebPage()
+	defer MustClosePage(page)
+
+	if _, err := page.Evaluate(`function() { var t = Date.now(); while (Date.now() - t < 2000) {} }`); err == nil {
+		t.Fatal("expected error")
+	} else if errors.Is(err, phantomjs.ErrProcessExited) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the HTTP shim rejects requests without the process token.
+func TestHTTPTransport_Unauthorized(t *testing.T) {
+	p := MustOpenNewProcess()
+	defer p.MustClose()
+
+	// Request without a token.
+	resp, err := http.Post(p.URL()+"/webpage/Create", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+
+	// Request with an invalid token.
+	req, err := http.NewRequest("POST", p.URL()+"/webpage/Create", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-PhantomJS-Token", "invalid")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+
+	// Requests through the process should still succeed.
+	MustClosePage(p.MustCreateWebPage())
+}